@@ -0,0 +1,100 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The cookie is named after the token, so that servers with different
+// tokens on the same host don't overwrite each other's.
+func (s *Server) tokenCookieName() string {
+	sum := sha256.Sum256([]byte(s.AccessToken))
+	return "reserve_token_" + hex.EncodeToString(sum[:4])
+}
+
+func (s *Server) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.AccessToken)) == 1
+}
+
+// authenticated reports whether a request has the access token, in its
+// cookie or its URL, or if none is needed.
+func (s *Server) authenticated(r *http.Request) bool {
+	if s.AccessToken == "" {
+		return true
+	}
+	if cookie, err := r.Cookie(s.tokenCookieName()); err == nil && s.validToken(cookie.Value) {
+		return true
+	}
+	return s.validToken(r.URL.Query().Get("token"))
+}
+
+// checkAccess decides whether to handle a request, and if it came from
+// someone without the access token. If the token is in the URL, it's saved
+// in a cookie and the browser is sent to the same URL without it.
+func (s *Server) checkAccess(w http.ResponseWriter, r *http.Request) (ok, readOnly bool) {
+	if s.AccessToken == "" {
+		return true, false
+	}
+	query := r.URL.Query()
+	if token := query.Get("token"); token != "" && s.validToken(token) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.tokenCookieName(),
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		if r.Method == http.MethodGet && r.Header.Get("Upgrade") == "" {
+			query.Del("token")
+			u := *r.URL
+			u.RawQuery = query.Encode()
+			http.Redirect(w, r, u.RequestURI(), http.StatusSeeOther)
+			return false, false
+		}
+		return true, false
+	}
+	if s.authenticated(r) {
+		return true, false
+	}
+	if s.ReadOnlyViewers {
+		return true, true
+	}
+	http.Error(w, "This server needs an access token. Use the link it printed when it started.", http.StatusUnauthorized)
+	return false, false
+}
+
+// checkOrigin allows WebSocket connections from pages served by reserve
+// itself, and from AllowedOrigins.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
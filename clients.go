@@ -0,0 +1,624 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy says what happens when a page falls too far behind on
+// messages.
+type OverflowPolicy int
+
+const (
+	// Throw away the oldest message waiting to be sent.
+	DropOldest OverflowPolicy = iota
+	// Throw away the new message.
+	DropNewest
+	// Disconnect the page. reserve.js will reconnect it, and it'll start
+	// over with the current state.
+	Disconnect
+)
+
+const (
+	DefaultClientQueueSize = 256
+	DefaultWriteTimeout    = 10 * time.Second
+	DefaultMaxMessageSize  = 4 << 20
+	// Per page, in messages per second.
+	DefaultBroadcastRate  = 100
+	DefaultBroadcastBurst = 200
+)
+
+// A client is one WebSocket connection to a page.
+type client struct {
+	conn  *websocket.Conn
+	conns *ClientConnections
+	// Stays the same when a page reconnects. Several connections can share
+	// an ID if a page is duplicated along with its session.
+	id        string
+	page      string
+	userAgent string
+
+	// Guarded by ClientConnections.lock.
+	channels map[string]bool
+	metadata interface{}
+
+	// Messages waiting to be sent. Guarded by queueLock.
+	queueLock sync.Mutex
+	queue     []frame
+	dropped   uint64
+	closed    bool
+	// A change to the shared state was dropped, so the client needs a new
+	// snapshot instead of any more changes.
+	resync bool
+	// Wakes up the writer when something's added to the queue.
+	ready chan struct{}
+	done  chan struct{}
+}
+
+// clientInfo is what other pages can find out about a client.
+type clientInfo struct {
+	ID        string      `json:"id"`
+	Page      string      `json:"page,omitempty"`
+	UserAgent string      `json:"userAgent,omitempty"`
+	Metadata  interface{} `json:"metadata,omitempty"`
+}
+
+func (c *client) info() clientInfo {
+	return clientInfo{c.id, c.page, c.userAgent, c.metadata}
+}
+
+// write queues a message to be sent to the client.
+func (c *client) write(message interface{}) {
+	if f, err := textFrame(message); err == nil {
+		c.enqueue(f)
+	}
+}
+
+// enqueue adds an encoded message to the queue without waiting. If the
+// queue is full, the ClientConnections' overflow policy decides what to do.
+func (c *client) enqueue(f frame) {
+	s := c.conns
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	if c.closed {
+		return
+	}
+	// The snapshot the client is waiting for will include this change, so
+	// there's no need to make room for it.
+	if f.state && c.resync {
+		return
+	}
+	if len(c.queue) >= s.queueSize {
+		switch s.overflow {
+		case DropNewest:
+			c.drop(f)
+			return
+		case Disconnect:
+			c.closed = true
+			atomic.AddUint64(&s.metrics.disconnected, 1)
+			// The read loop notices and cleans up.
+			c.conn.Close()
+			return
+		default:
+			c.drop(c.queue[0])
+			c.queue = c.queue[1:]
+		}
+	}
+	c.queue = append(c.queue, f)
+	c.wake()
+}
+
+// drop throws away a message. The queue lock must be held.
+func (c *client) drop(f frame) {
+	c.dropped++
+	atomic.AddUint64(&c.conns.metrics.dropped, 1)
+	if f.state && !c.resync {
+		c.resync = true
+		c.wake()
+	}
+}
+
+func (c *client) wake() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// resyncState replaces any changes to the shared state waiting to be sent
+// with a snapshot, at the front of the queue. No changes are made in the
+// meantime, so the snapshot includes every one that was left out.
+func (c *client) resyncState() {
+	c.conns.state.withSnapshot(func(snapshot stateSnapshot) {
+		f, err := textFrame(Message{Name: "state-snapshot", Value: snapshot})
+		c.queueLock.Lock()
+		defer c.queueLock.Unlock()
+		c.resync = false
+		if err != nil {
+			return
+		}
+		queue := []frame{f}
+		for _, queued := range c.queue {
+			if !queued.state {
+				queue = append(queue, queued)
+			}
+		}
+		c.queue = queue
+	})
+}
+
+// writeLoop sends queued messages until the client is closed. A write that
+// takes longer than the write timeout closes the connection.
+func (c *client) writeLoop() {
+	for {
+		select {
+		case <-c.ready:
+		case <-c.done:
+			return
+		}
+		c.queueLock.Lock()
+		resync := c.resync
+		c.queueLock.Unlock()
+		if resync {
+			c.resyncState()
+		}
+		c.queueLock.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.queueLock.Unlock()
+		for _, f := range queue {
+			c.conn.SetWriteDeadline(time.Now().Add(c.conns.writeTimeout))
+			if err := c.conn.WriteMessage(f.typ, f.data); err != nil {
+				c.conn.Close()
+				return
+			}
+			atomic.AddUint64(&c.conns.metrics.sent, 1)
+		}
+	}
+}
+
+// close stops the writer. Anything still queued is thrown away.
+func (c *client) close() {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	c.closed = true
+	c.queue = nil
+	close(c.done)
+}
+
+// clientID derives a client's ID from the session token its page keeps.
+// IDs are shared with other pages, so they can't be used to take over a
+// session. Without a token, the client gets a random ID.
+func clientID(session string) string {
+	if session == "" {
+		var b [8]byte
+		rand.Read(b[:])
+		return hex.EncodeToString(b[:])
+	}
+	sum := sha256.Sum256([]byte(session))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *ClientConnections) newClient(conn *websocket.Conn, r *http.Request) *client {
+	c := &client{
+		conn:      conn,
+		conns:     s,
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		id:        clientID(r.URL.Query().Get("session")),
+		page:      r.URL.Query().Get("page"),
+		userAgent: r.UserAgent(),
+		channels:  make(map[string]bool),
+	}
+	go c.writeLoop()
+	return c
+}
+
+type connectionMetrics struct {
+	sent         uint64
+	dropped      uint64
+	disconnected uint64
+}
+
+type ClientConnections struct {
+	// First, so that it's aligned for atomic access as long as the
+	// ClientConnections is allocated on its own.
+	metrics connectionMetrics
+
+	clients []*client
+	lock    sync.Mutex
+
+	queueSize    int
+	overflow     OverflowPolicy
+	writeTimeout time.Duration
+	// For clients that need a new snapshot after missing a change.
+	state *stateStore
+}
+
+// metricsReport is served at /.reserve/metrics.
+type metricsReport struct {
+	Clients int `json:"clients"`
+	// Messages sent to pages, and thrown away because a page fell behind.
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+	// Pages disconnected for falling behind.
+	Disconnected uint64          `json:"disconnected"`
+	PerClient    []clientMetrics `json:"perClient"`
+}
+
+type clientMetrics struct {
+	ID      string `json:"id"`
+	Page    string `json:"page,omitempty"`
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+func (s *ClientConnections) report() metricsReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	report := metricsReport{
+		Clients:      len(s.clients),
+		Sent:         atomic.LoadUint64(&s.metrics.sent),
+		Dropped:      atomic.LoadUint64(&s.metrics.dropped),
+		Disconnected: atomic.LoadUint64(&s.metrics.disconnected),
+		PerClient:    []clientMetrics{},
+	}
+	for _, c := range s.clients {
+		c.queueLock.Lock()
+		report.PerClient = append(report.PerClient, clientMetrics{c.id, c.page, len(c.queue), c.dropped})
+		c.queueLock.Unlock()
+	}
+	return report
+}
+
+// hasID reports whether a client other than c has c's ID. The lock must be
+// held.
+func (s *ClientConnections) hasID(c *client) bool {
+	for _, other := range s.clients {
+		if other != c && other.id == c.id {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyOthers sends a message about c to every other client. The lock must
+// be held.
+func (s *ClientConnections) notifyOthers(c *client, name string) {
+	for _, other := range s.clients {
+		if other.id != c.id {
+			other.write(Message{Name: name, Value: c.info()})
+		}
+	}
+}
+
+// add adds a client. If it's the first with its ID, everyone else hears
+// that it joined.
+func (s *ClientConnections) add(c *client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.hasID(c) {
+		s.notifyOthers(c, "clientjoin")
+	}
+	s.clients = append(s.clients, c)
+}
+
+// remove removes a client. If it was the last with its ID, everyone else
+// hears that it left.
+func (s *ClientConnections) remove(c *client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, cur := range s.clients {
+		if cur == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	if !s.hasID(c) {
+		s.notifyOthers(c, "clientleave")
+	}
+}
+
+// list describes the connected clients, one per ID.
+func (s *ClientConnections) list() []clientInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	infos := []clientInfo{}
+	seen := make(map[string]bool)
+	for _, c := range s.clients {
+		if !seen[c.id] {
+			seen[c.id] = true
+			infos = append(infos, c.info())
+		}
+	}
+	return infos
+}
+
+func (s *ClientConnections) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// broadcast sends a message to every client.
+func (s *ClientConnections) broadcast(message interface{}) {
+	f, err := textFrame(message)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.clients {
+		c.enqueue(f)
+	}
+}
+
+// broadcastState tells every client about a change to the shared state.
+func (s *ClientConnections) broadcastState(change stateChange) {
+	f, err := textFrame(Message{Name: "state", Value: change})
+	if err != nil {
+		return
+	}
+	f.state = true
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.clients {
+		c.enqueue(f)
+	}
+}
+
+// broadcastTo sends a message to the clients that have joined channel,
+// except for exclude (which may be nil), and returns how many there were.
+func (s *ClientConnections) broadcastTo(channel string, f frame, exclude *client) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, c := range s.clients {
+		if !c.channels[channel] || c == exclude {
+			continue
+		}
+		c.enqueue(f)
+		n++
+	}
+	return n
+}
+
+// sendTo sends a message to the client (or clients) with an ID.
+func (s *ClientConnections) sendTo(id string, f frame) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.clients {
+		if c.id != id {
+			continue
+		}
+		c.enqueue(f)
+	}
+}
+
+func (s *ClientConnections) setMetadata(c *client, metadata interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c.metadata = metadata
+	s.notifyOthers(c, "clientupdate")
+}
+
+func (s *ClientConnections) join(c *client, channel string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c.channels[channel] = true
+}
+
+func (s *ClientConnections) leave(c *client, channel string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(c.channels, channel)
+}
+
+// errorMessage tells a page that something it asked for didn't happen.
+type errorMessage struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (c *client) writeError(ref int, code, message string) {
+	c.write(Message{Name: "error", Value: errorMessage{code, message}, Ref: ref})
+}
+
+// readMessage reads the next message from conn, up to max bytes unless max
+// is negative. The rest of a message that's too big is thrown away.
+func readMessage(conn *websocket.Conn, max int64) (typ int, data []byte, tooBig bool, err error) {
+	typ, r, err := conn.NextReader()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if max < 0 {
+		data, err = io.ReadAll(r)
+		return typ, data, false, err
+	}
+	data, err = io.ReadAll(io.LimitReader(r, max+1))
+	if err == nil && int64(len(data)) > max {
+		tooBig = true
+		_, err = io.Copy(io.Discard, r)
+	}
+	return typ, data, tooBig, err
+}
+
+// serveClient handles messages from a client until its connection closes.
+// A readOnly client can listen, but not send messages or change anything.
+func (s *Server) serveClient(conn *websocket.Conn, r *http.Request, readOnly bool) {
+	conns := s.conns
+	defer conn.Close()
+	c := conns.newClient(conn, r)
+	defer c.close()
+	maxSize := s.MaxMessageSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	c.write(Message{Name: "welcome", Value: struct {
+		ID             string `json:"id"`
+		MaxMessageSize int64  `json:"maxMessageSize"`
+	}{c.id, maxSize}})
+	// Changes wait until the client has been added and its snapshot is
+	// queued, so it hears about each one exactly once, in order.
+	s.state.withSnapshot(func(snapshot stateSnapshot) {
+		conns.add(c)
+		c.write(Message{Name: "state-snapshot", Value: snapshot})
+	})
+	defer conns.remove(c)
+
+	var limiter *tokenBucket
+	if s.BroadcastRate >= 0 {
+		rate, burst := s.BroadcastRate, s.BroadcastBurst
+		if rate == 0 {
+			rate = DefaultBroadcastRate
+		}
+		if burst <= 0 {
+			burst = DefaultBroadcastBurst
+		}
+		limiter = newTokenBucket(rate, burst)
+	}
+	for {
+		typ, data, tooBig, err := readMessage(conn, maxSize)
+		if err != nil {
+			break
+		}
+		var msg Message
+		// Set (even if empty) for binary messages.
+		var payload []byte
+		if typ == websocket.BinaryMessage {
+			msg, payload, err = parseBinaryFrame(data)
+		} else {
+			err = json.Unmarshal(data, &msg)
+		}
+		if tooBig {
+			// The header of a binary message may have made it, to say
+			// which request this is. reserve.js checks the size of text
+			// messages itself.
+			c.writeError(msg.Ref, "too-big", fmt.Sprintf("messages can be at most %d bytes", maxSize))
+			continue
+		} else if err != nil {
+			c.writeError(0, "invalid", "couldn't read a message: "+err.Error())
+			continue
+		}
+		switch msg.Name {
+		// Everything that's passed on to other pages.
+		case "broadcast", "send", "metadata", "state-set", "state-patch", "state-delete":
+			if readOnly {
+				c.writeError(msg.Ref, "read-only", "only people with the access token can send messages")
+				continue
+			}
+			if limiter != nil && !limiter.allow(time.Now()) {
+				c.writeError(msg.Ref, "rate-limited", "too many messages; slow down")
+				continue
+			}
+		}
+		// encode encodes a message to pass along, with the same payload as
+		// the one being handled.
+		encode := func(out Message) (frame, error) {
+			if payload != nil {
+				return binaryFrame(out, payload)
+			}
+			return textFrame(out)
+		}
+		switch msg.Name {
+		case "broadcast":
+			var exclude *client
+			if msg.ExcludeSelf {
+				exclude = c
+			}
+			out := Message{
+				Name:    "broadcast",
+				Value:   msg.Value,
+				Channel: msg.Channel,
+				ID:      msg.ID,
+				From:    c.id,
+			}
+			f, err := encode(out)
+			if err != nil {
+				continue
+			}
+			// Pages say which channel to use; reserve.js defaults to the
+			// page's own path.
+			n := conns.broadcastTo(msg.Channel, f, exclude)
+			// Binary messages aren't kept.
+			if s.HistorySize > 0 && payload == nil {
+				s.history.add(out)
+				s.storeChanged()
+			}
+			if msg.Ref != 0 {
+				c.write(Message{Name: "ack", Value: struct {
+					ID         string `json:"id,omitempty"`
+					Recipients int    `json:"recipients"`
+				}{msg.ID, n}, Ref: msg.Ref})
+			}
+		case "send":
+			if f, err := encode(Message{Name: "direct", Value: msg.Value, From: c.id}); err == nil {
+				conns.sendTo(msg.To, f)
+			}
+		case "metadata":
+			conns.setMetadata(c, msg.Value)
+		case "state-set", "state-patch", "state-delete":
+			change, err := s.state.handleMessage(msg, conns.broadcastState)
+			if err != nil {
+				code := "invalid"
+				if err == errStateConflict {
+					code = "conflict"
+				}
+				c.writeError(msg.Ref, code, err.Error())
+				continue
+			}
+			s.storeChanged()
+			if msg.Ref != 0 {
+				c.write(Message{Name: "ack", Value: struct {
+					Version int `json:"version"`
+				}{change.Version}, Ref: msg.Ref})
+			}
+		case "clients":
+			c.write(Message{Name: "clients", Value: conns.list(), Ref: msg.Ref})
+		case "join":
+			if channel, ok := msg.Value.(string); ok {
+				conns.join(c, channel)
+				for _, past := range s.history.get(channel) {
+					past.History = true
+					c.write(past)
+				}
+			}
+		case "leave":
+			if channel, ok := msg.Value.(string); ok {
+				conns.leave(c, channel)
+			}
+		case "ping":
+			startTime, _ := msg.Value.(float64)
+			c.write(Message{Name: "pong", Value: struct {
+				StartTime  float64 `json:"startTime"`
+				ServerTime int64   `json:"serverTime"`
+			}{startTime, time.Now().UnixNano() / int64(time.Millisecond)}})
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Pages with a Content-Security-Policy would block reserve's scripts and
+// its WebSocket connection, so policies in served pages are loosened just
+// enough to allow them.
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+func parseCSPPolicy(policy string) []cspDirective {
+	var directives []cspDirective
+	for _, part := range strings.Split(policy, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		directives = append(directives, cspDirective{strings.ToLower(fields[0]), fields[1:]})
+	}
+	return directives
+}
+
+func findCSPDirective(directives []cspDirective, name string) int {
+	for i, d := range directives {
+		if d.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func addCSPSource(sources []string, source string) []string {
+	var out []string
+	for _, s := range sources {
+		if strings.ToLower(s) == "'none'" {
+			continue
+		}
+		if s == source {
+			return sources
+		}
+		out = append(out, s)
+	}
+	return append(out, source)
+}
+
+// usesNoncesOrHashes reports whether 'unsafe-inline' is ignored for a list
+// of sources. If it isn't, adding a nonce would turn it off.
+func usesNoncesOrHashes(sources []string) bool {
+	for _, s := range sources {
+		s = strings.ToLower(s)
+		if strings.HasPrefix(s, "'nonce-") || strings.HasPrefix(s, "'sha") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCSPSource(sources []string, source string) bool {
+	for _, s := range sources {
+		if strings.ToLower(s) == source {
+			return true
+		}
+	}
+	return false
+}
+
+// allowSources adds sources to each of names that's present, since the
+// browser may consult any of them, or, if none are, to a copy of
+// default-src under the last (most general) name.
+func allowSources(directives []cspDirective, names []string, add func([]string) []string) []cspDirective {
+	found := false
+	for _, name := range names {
+		if i := findCSPDirective(directives, name); i >= 0 {
+			directives[i].sources = add(directives[i].sources)
+			found = true
+		}
+	}
+	if found {
+		return directives
+	}
+	if i := findCSPDirective(directives, "default-src"); i >= 0 {
+		sources := append([]string{}, directives[i].sources...)
+		directives = append(directives, cspDirective{names[len(names)-1], add(sources)})
+	}
+	return directives
+}
+
+// allowReserve rewrites a Content-Security-Policy (which may be several
+// policies separated by commas) so that it allows reserve's scripts, using
+// nonce, and its WebSocket connection to host.
+func allowReserve(policy, nonce, host string) string {
+	policies := strings.Split(policy, ",")
+	for i, p := range policies {
+		directives := parseCSPPolicy(p)
+		directives = allowSources(directives, []string{"script-src-elem", "script-src"}, func(sources []string) []string {
+			if hasCSPSource(sources, "'unsafe-inline'") && !usesNoncesOrHashes(sources) {
+				// A nonce would switch off 'unsafe-inline', which the page
+				// depends on, so allow the scripts by location instead.
+				sources = addCSPSource(sources, "http://"+host+"/.reserve/")
+				return addCSPSource(sources, "https://"+host+"/.reserve/")
+			}
+			return addCSPSource(sources, "'nonce-"+nonce+"'")
+		})
+		directives = allowSources(directives, []string{"connect-src"}, func(sources []string) []string {
+			sources = addCSPSource(sources, "ws://"+host+"/.reserve/ws")
+			return addCSPSource(sources, "wss://"+host+"/.reserve/ws")
+		})
+		parts := make([]string, len(directives))
+		for j, d := range directives {
+			parts[j] = strings.Join(append([]string{d.name}, d.sources...), " ")
+		}
+		policies[i] = strings.Join(parts, "; ")
+	}
+	return strings.Join(policies, ", ")
+}
+
+var attrEscaper = strings.NewReplacer(`&`, "&amp;", `"`, "&quot;")
+
+var cspHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+
+func allowReserveInHeader(h http.Header, nonce, host string) {
+	for _, name := range cspHeaders {
+		values := h[name]
+		for i, v := range values {
+			values[i] = allowReserve(v, nonce, host)
+		}
+	}
+}
+
+// allowReserveInMetaTag returns a function for HTMLSuffixer.RewriteHeadTag
+// which rewrites <meta http-equiv="Content-Security-Policy"> tags.
+func allowReserveInMetaTag(nonce, host string) func(string, []byte) []byte {
+	return func(name string, tag []byte) []byte {
+		if name != "meta" {
+			return tag
+		}
+		attrs := htmlAttrs(tag)
+		isCSP := false
+		for _, attr := range attrs {
+			if attr.name == "http-equiv" && strings.EqualFold(strings.TrimSpace(attr.value), "content-security-policy") {
+				isCSP = true
+			}
+		}
+		if !isCSP {
+			return tag
+		}
+		for _, attr := range attrs {
+			if attr.name == "content" {
+				var out bytes.Buffer
+				out.Write(tag[:attr.start])
+				out.WriteString(`"` + attrEscaper.Replace(allowReserve(attr.value, nonce, host)) + `"`)
+				out.Write(tag[attr.end:])
+				return out.Bytes()
+			}
+		}
+		return tag
+	}
+}
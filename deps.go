@@ -0,0 +1,135 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/s4y/reserve/httpsuffixer"
+)
+
+var (
+	htmlRefMatcher = regexp.MustCompile(`(?i)<(?:link|script|img|source|iframe|video|audio|embed|track)\b[^>]*?\s(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	cssRefMatcher  = regexp.MustCompile(`(?i)(?:@import\s+(?:url\(\s*)?|url\(\s*)(?:"([^"]*)"|'([^']*)'|([^\s"')]+))`)
+	jsRefMatcher   = regexp.MustCompile(`(?:\bimport\s*(?:[\w*{}\s,$]+\sfrom\s*)?|\bexport\s*[\w*{}\s,$]+\sfrom\s*|\bimport\s*\(\s*)(?:"([^"]*)"|'([^']*)')`)
+)
+
+// Don't bother looking for references past the first megabyte of anything.
+const maxDependencyScan = 1 << 20
+
+// dependencies keeps track of what each served page, stylesheet and script
+// refers to, so that a change to a file can be traced back to everything
+// that pulls it in, like a page which links to a stylesheet which @imports
+// the file that changed.
+type dependencies struct {
+	lock      sync.Mutex
+	refs      map[string][]string
+	referrers map[string]map[string]bool
+}
+
+func (d *dependencies) set(from string, refs []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.refs == nil {
+		d.refs = make(map[string][]string)
+		d.referrers = make(map[string]map[string]bool)
+	}
+	for _, ref := range d.refs[from] {
+		delete(d.referrers[ref], from)
+	}
+	d.refs[from] = refs
+	for _, ref := range refs {
+		if d.referrers[ref] == nil {
+			d.referrers[ref] = make(map[string]bool)
+		}
+		d.referrers[ref][from] = true
+	}
+}
+
+// affected returns every resource which refers to urlPath, directly or
+// indirectly.
+func (d *dependencies) affected(urlPath string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	seen := map[string]bool{urlPath: true}
+	queue := []string{urlPath}
+	var affected []string
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for referrer := range d.referrers[cur] {
+			if !seen[referrer] {
+				seen[referrer] = true
+				affected = append(affected, referrer)
+				queue = append(queue, referrer)
+			}
+		}
+	}
+	sort.Strings(affected)
+	return affected
+}
+
+func findRefs(base *url.URL, data []byte, matchers ...*regexp.Regexp) []string {
+	seen := make(map[string]bool)
+	var refs []string
+	for _, matcher := range matchers {
+		for _, match := range matcher.FindAllSubmatch(data, -1) {
+			var ref string
+			for _, group := range match[1:] {
+				if group != nil {
+					ref = string(group)
+					break
+				}
+			}
+			u, err := base.Parse(ref)
+			if err != nil || u.Host != base.Host || u.Path == base.Path {
+				continue
+			}
+			if !seen[u.Path] {
+				seen[u.Path] = true
+				refs = append(refs, u.Path)
+			}
+		}
+	}
+	return refs
+}
+
+// dependencyScanner is a Tweaker which passes a response through (to another
+// Tweaker, if there is one) while collecting it, then records what it
+// refers to when it's done.
+type dependencyScanner struct {
+	next     httpsuffixer.Tweaker
+	deps     *dependencies
+	base     *url.URL
+	matchers []*regexp.Regexp
+	buf      []byte
+}
+
+func (t *dependencyScanner) Tweak(data []byte) []byte {
+	if data == nil {
+		if len(t.buf) > 0 {
+			t.deps.set(t.base.Path, findRefs(t.base, t.buf, t.matchers...))
+		}
+	} else if len(t.buf) < maxDependencyScan {
+		t.buf = append(t.buf, data...)
+	}
+	if t.next != nil {
+		return t.next.Tweak(data)
+	}
+	return data
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// A frame is one encoded WebSocket message.
+type frame struct {
+	typ  int
+	data []byte
+	// A change to the shared state, which a page can't miss without getting
+	// out of sync.
+	state bool
+}
+
+func textFrame(message interface{}) (frame, error) {
+	data, err := json.Marshal(message)
+	return frame{typ: websocket.TextMessage, data: data}, err
+}
+
+// Binary messages start with a Message, as JSON and without a value, and
+// then the payload. The header's length comes first, as two big-endian
+// bytes. Payloads are passed along without being looked at.
+func binaryFrame(header Message, payload []byte) (frame, error) {
+	header.Value = nil
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return frame{}, err
+	}
+	if len(headerData) > 0xffff {
+		return frame{}, errBinaryHeader
+	}
+	data := make([]byte, 2, 2+len(headerData)+len(payload))
+	binary.BigEndian.PutUint16(data, uint16(len(headerData)))
+	data = append(data, headerData...)
+	data = append(data, payload...)
+	return frame{typ: websocket.BinaryMessage, data: data}, nil
+}
+
+var errBinaryHeader = errors.New("binary message header is malformed")
+
+// parseBinaryFrame splits a binary message into its header and payload.
+// The payload is never nil.
+func parseBinaryFrame(data []byte) (Message, []byte, error) {
+	var header Message
+	if len(data) < 2 {
+		return header, nil, errBinaryHeader
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return header, nil, errBinaryHeader
+	}
+	if err := json.Unmarshal(data[2:2+n], &header); err != nil {
+		return header, nil, err
+	}
+	return header, data[2+n:], nil
+}
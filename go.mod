@@ -3,8 +3,10 @@ module github.com/s4y/reserve
 go 1.17
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/rjeczalik/notify v0.9.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 )
 
 require golang.org/x/sys v0.26.0 // indirect
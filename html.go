@@ -0,0 +1,393 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"bytes"
+	"html"
+	"unicode/utf8"
+)
+
+type htmlTokenKind int
+
+const (
+	htmlText htmlTokenKind = iota
+	htmlComment
+	// Doctypes, processing instructions (like <?xml ...?>), and other
+	// things which aren't tags or comments.
+	htmlDeclaration
+	htmlStartTag
+	htmlEndTag
+)
+
+type htmlToken struct {
+	kind htmlTokenKind
+	// Lowercase, for tags.
+	name string
+	// How many bytes the token covers.
+	len int
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// runeStart backs n up, if needed, so that data[:n] doesn't end partway
+// through a UTF-8 sequence.
+func runeStart(data []byte, n int) int {
+	for i := n; i > 0 && n-i < utf8.UTFMax; i-- {
+		if i == len(data) || utf8.RuneStart(data[i]) {
+			return i
+		}
+	}
+	return n
+}
+
+func tagName(data []byte) string {
+	end := 0
+	for end < len(data) && !isHTMLSpace(data[end]) && data[end] != '/' && data[end] != '>' {
+		end++
+	}
+	return string(bytes.ToLower(data[:end]))
+}
+
+// nextHTMLToken reads one token from the start of data. It's a much looser
+// tokenizer than a browser's, but it's enough to find tags and skip over
+// comments and quoted attributes. If data ends partway through a token and
+// more is coming (atEOF is false), it returns false. Text tokens are
+// returned a piece at a time.
+func nextHTMLToken(data []byte, atEOF bool) (htmlToken, bool) {
+	if len(data) == 0 {
+		return htmlToken{}, false
+	}
+	until := func(kind htmlTokenKind, name string, from int, end string) (htmlToken, bool) {
+		if i := bytes.Index(data[from:], []byte(end)); i >= 0 {
+			return htmlToken{kind, name, from + i + len(end)}, true
+		} else if atEOF {
+			return htmlToken{kind, name, len(data)}, true
+		}
+		return htmlToken{}, false
+	}
+
+	if data[0] != '<' {
+		end := bytes.IndexByte(data, '<')
+		if end < 0 {
+			end = len(data)
+			if !atEOF {
+				end = runeStart(data, end)
+			}
+		}
+		if end == 0 {
+			return htmlToken{}, false
+		}
+		return htmlToken{htmlText, "", end}, true
+	}
+	if len(data) < 4 && !atEOF {
+		// Too short to tell what it is yet.
+		if bytes.HasPrefix([]byte("<!--"), data) || len(data) < 2 {
+			return htmlToken{}, false
+		}
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("<!--")):
+		return until(htmlComment, "", 2, "-->")
+	case bytes.HasPrefix(data, []byte("<!")), bytes.HasPrefix(data, []byte("<?")):
+		return until(htmlDeclaration, "", 2, ">")
+	case len(data) > 2 && data[1] == '/' && isASCIILetter(data[2]):
+		return until(htmlEndTag, tagName(data[2:]), 2, ">")
+	case len(data) > 1 && isASCIILetter(data[1]):
+		name := tagName(data[1:])
+		var quote byte
+		for i := 1 + len(name); i < len(data); i++ {
+			switch c := data[i]; {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '"' || c == '\'':
+				quote = c
+			case c == '>':
+				return htmlToken{htmlStartTag, name, i + 1}, true
+			}
+		}
+		if atEOF {
+			return htmlToken{htmlStartTag, name, len(data)}, true
+		}
+		return htmlToken{}, false
+	case len(data) < 3 && !atEOF:
+		return htmlToken{}, false
+	}
+	// A "<" that doesn't start anything is just text.
+	return htmlToken{htmlText, "", 1}, true
+}
+
+// Elements whose contents aren't parsed as HTML, so that "<" inside them
+// doesn't start a tag.
+var rawTextElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"textarea": true,
+	"title":    true,
+	"xmp":      true,
+	"iframe":   true,
+	"noembed":  true,
+	"noframes": true,
+}
+
+// An htmlAttr is one attribute of a tag. Start and end are the span of the
+// value in the tag, including any quotes.
+type htmlAttr struct {
+	name       string
+	value      string
+	start, end int
+}
+
+// htmlAttrs parses the attributes of a start tag.
+func htmlAttrs(tag []byte) []htmlAttr {
+	var attrs []htmlAttr
+	i := 1 + len(tagName(tag[1:]))
+	for i < len(tag) {
+		for i < len(tag) && (isHTMLSpace(tag[i]) || tag[i] == '/') {
+			i++
+		}
+		nameStart := i
+		for i < len(tag) && !isHTMLSpace(tag[i]) && tag[i] != '/' && tag[i] != '>' && tag[i] != '=' {
+			i++
+		}
+		if i == nameStart {
+			break
+		}
+		attr := htmlAttr{name: string(bytes.ToLower(tag[nameStart:i])), start: i, end: i}
+		for i < len(tag) && isHTMLSpace(tag[i]) {
+			i++
+		}
+		if i < len(tag) && tag[i] == '=' {
+			i++
+			for i < len(tag) && isHTMLSpace(tag[i]) {
+				i++
+			}
+			attr.start = i
+			if i < len(tag) && (tag[i] == '"' || tag[i] == '\'') {
+				quote := tag[i]
+				end := bytes.IndexByte(tag[i+1:], quote)
+				if end < 0 {
+					end = len(tag) - i - 1
+				}
+				attr.value = html.UnescapeString(string(tag[i+1 : i+1+end]))
+				i += end + 2
+			} else {
+				for i < len(tag) && !isHTMLSpace(tag[i]) && tag[i] != '>' {
+					i++
+				}
+				attr.value = html.UnescapeString(string(tag[attr.start:i]))
+			}
+			if i > len(tag) {
+				i = len(tag)
+			}
+			attr.end = i
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// Elements that can appear in <head>.
+var headElements = map[string]bool{
+	"base":     true,
+	"link":     true,
+	"meta":     true,
+	"noscript": true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+	"title":    true,
+}
+
+// Placement says where HTMLSuffixer puts its suffix.
+type Placement int
+
+const (
+	// At the start of <head>, or where <head> would be if it's left out.
+	InHead Placement = iota
+	// Just before </body>, or at the end of the document.
+	BeforeBodyEnd
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// If this much of a document goes by in one token, it's passed through as
+// text instead of held any longer.
+const maxHTMLSuffixerBuffer = 64 << 10
+
+// HTMLSuffixer is a Tweaker which inserts Suffix into an HTML document.
+type HTMLSuffixer struct {
+	Suffix    []byte
+	Placement Placement
+	// If set, RewriteHeadTag can change any start tag in the document's
+	// <head>. It's passed the tag's lowercase name and all of its bytes.
+	RewriteHeadTag func(name string, tag []byte) []byte
+
+	started  bool
+	inserted bool
+	done     bool
+	pastHead bool
+	buf      []byte
+	// The element whose raw text is being passed through, if any.
+	rawText string
+}
+
+// endsHead reports whether tok comes after the document's head.
+func endsHead(tok htmlToken, data []byte) bool {
+	switch tok.kind {
+	case htmlText:
+		return len(bytes.TrimLeft(data, " \t\n\r\f")) != 0
+	case htmlStartTag:
+		return tok.name != "html" && tok.name != "head" && !headElements[tok.name]
+	case htmlEndTag:
+		return tok.name == "head" || tok.name == "html" || tok.name == "body"
+	}
+	return false
+}
+
+// insertsBefore reports whether, in InHead mode, the suffix goes before tok:
+// anything but whitespace, comments, doctypes and the <html> and <head> tags
+// means that head has started.
+func insertsBefore(tok htmlToken, data []byte) bool {
+	switch tok.kind {
+	case htmlText:
+		return len(bytes.TrimLeft(data, " \t\n\r\f")) != 0
+	case htmlStartTag:
+		return tok.name != "html" && tok.name != "head"
+	case htmlEndTag:
+		return true
+	}
+	return false
+}
+
+// indexEndTag finds end, like "</script", in data, ignoring ASCII case.
+// The document may not be UTF-8, so it's searched as-is instead of
+// lowercased.
+func indexEndTag(data, end []byte) int {
+	for i := 0; i+len(end) <= len(data); i++ {
+		j := bytes.Index(data[i:], end[:2])
+		if j < 0 || i+j+len(end) > len(data) {
+			return -1
+		}
+		i += j
+		if bytes.EqualFold(data[i:i+len(end)], end) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *HTMLSuffixer) Tweak(data []byte) []byte {
+	if t.done {
+		return data
+	}
+	atEOF := data == nil
+	t.buf = append(t.buf, data...)
+
+	var out []byte
+	insert := func() {
+		out = append(out, t.Suffix...)
+		t.inserted = true
+	}
+	if !t.started {
+		if bytes.HasPrefix(t.buf, utf8BOM) {
+			out = append(out, utf8BOM...)
+			t.buf = t.buf[len(utf8BOM):]
+		} else if !atEOF && bytes.HasPrefix(utf8BOM, t.buf) {
+			return nil
+		}
+		t.started = true
+	}
+	for len(t.buf) > 0 {
+		if t.inserted && t.Placement == InHead && (t.pastHead || t.RewriteHeadTag == nil) {
+			// Nothing left to do.
+			out = append(out, t.buf...)
+			t.buf = nil
+			t.done = true
+			break
+		}
+		if t.rawText != "" {
+			end := []byte("</" + t.rawText)
+			i := indexEndTag(t.buf, end)
+			if i < 0 {
+				// Keep back anything that might be the start of the end tag.
+				i = 0
+				if atEOF {
+					i = len(t.buf)
+				} else if len(t.buf) > len(end) {
+					i = runeStart(t.buf, len(t.buf)-len(end))
+				}
+				out = append(out, t.buf[:i]...)
+				t.buf = t.buf[i:]
+				break
+			}
+			out = append(out, t.buf[:i]...)
+			t.buf = t.buf[i:]
+			t.rawText = ""
+		}
+		tok, ok := nextHTMLToken(t.buf, atEOF)
+		if !ok {
+			if len(t.buf) > maxHTMLSuffixerBuffer {
+				tok = htmlToken{htmlText, "", runeStart(t.buf, len(t.buf))}
+			} else {
+				break
+			}
+		}
+		if tok.kind == htmlText {
+			// Leading whitespace is its own token, so that where text is
+			// split doesn't change where the suffix goes.
+			space := tok.len - len(bytes.TrimLeft(t.buf[:tok.len], " \t\n\r\f"))
+			if space > 0 && space < tok.len {
+				tok.len = space
+			}
+		}
+		data := t.buf[:tok.len]
+		if !t.inserted && t.Placement == InHead && insertsBefore(tok, data) {
+			insert()
+		} else if !t.inserted && t.Placement == BeforeBodyEnd && tok.kind == htmlEndTag && tok.name == "body" {
+			insert()
+		}
+		if !t.pastHead && endsHead(tok, data) {
+			t.pastHead = true
+		}
+		if tok.kind == htmlStartTag && !t.pastHead && t.RewriteHeadTag != nil {
+			data = t.RewriteHeadTag(tok.name, data)
+		}
+		out = append(out, data...)
+		if !t.inserted && t.Placement == InHead && tok.kind == htmlStartTag && tok.name == "head" {
+			insert()
+		}
+		if tok.kind == htmlStartTag && rawTextElements[tok.name] {
+			t.rawText = tok.name
+		}
+		t.buf = t.buf[tok.len:]
+	}
+	if atEOF && !t.inserted {
+		insert()
+	}
+	if len(t.buf) > 0 {
+		// Don't hang on to the caller's memory.
+		t.buf = append([]byte{}, t.buf...)
+	}
+	return out
+}
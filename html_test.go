@@ -0,0 +1,148 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"bytes"
+	"testing"
+)
+
+// markMeta stands in for a RewriteHeadTag which changes <meta> tags.
+func markMeta(name string, tag []byte) []byte {
+	if name != "meta" {
+		return tag
+	}
+	return append([]byte("<meta data-marked"), tag[len("<meta"):]...)
+}
+
+var htmlSuffixerTests = []struct {
+	name      string
+	placement Placement
+	rewrite   bool
+	in, want  string
+}{
+	{"head", InHead, false,
+		"<!DOCTYPE html><html><head><title>x</title></head><body>hi</body></html>",
+		"<!DOCTYPE html><html><head><S><title>x</title></head><body>hi</body></html>"},
+	{"uppercase head", InHead, false,
+		"<HTML><HEAD><TITLE>x</TITLE>",
+		"<HTML><HEAD><S><TITLE>x</TITLE>"},
+	{"head with attributes", InHead, false,
+		`<head data-x="a>b" data-y='<head>'><title>x</title>`,
+		`<head data-x="a>b" data-y='<head>'><S><title>x</title>`},
+	{"no head", InHead, false,
+		"<!doctype html>\n<title>x</title><p>hi",
+		"<!doctype html>\n<S><title>x</title><p>hi"},
+	{"no doctype", InHead, false,
+		"<p>hi</p>",
+		"<S><p>hi</p>"},
+	{"text only", InHead, false,
+		"  hi",
+		"  <S>hi"},
+	{"empty", InHead, false,
+		"",
+		"<S>"},
+	{"BOM", InHead, false,
+		"\xef\xbb\xbf<!doctype html><p>hi",
+		"\xef\xbb\xbf<!doctype html><S><p>hi"},
+	{"BOM only", InHead, false,
+		"\xef\xbb\xbf",
+		"\xef\xbb\xbf<S>"},
+	{"comments", InHead, false,
+		"<!-- <head> <p> --><html><!----><head><title>x</title>",
+		"<!-- <head> <p> --><html><!----><head><S><title>x</title>"},
+	{"XML prolog", InHead, false,
+		"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head>",
+		"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><S>"},
+	{"multi-byte text", InHead, false,
+		"h\xc3\xa9llo \xe2\x98\x83\xf0\x9f\x98\x80",
+		"<S>h\xc3\xa9llo \xe2\x98\x83\xf0\x9f\x98\x80"},
+	{"multi-byte title", InHead, false,
+		"<head><title>\xe2\x98\x83 <\xe2\x98\x83></title>",
+		"<head><S><title>\xe2\x98\x83 <\xe2\x98\x83></title>"},
+	{"stray <", InHead, false,
+		"< 3 <3",
+		"<S>< 3 <3"},
+
+	{"before body end", BeforeBodyEnd, false,
+		"<html><head></head><body><p>hi</p></body></html>",
+		"<html><head></head><body><p>hi</p><S></body></html>"},
+	{"uppercase body end", BeforeBodyEnd, false,
+		"<body>hi</BODY >",
+		"<body>hi<S></BODY >"},
+	{"body end in comment", BeforeBodyEnd, false,
+		"<body><!-- </body> -->hi</body>",
+		"<body><!-- </body> -->hi<S></body>"},
+	{"body end in script", BeforeBodyEnd, false,
+		"<body><script>let s = '</body>';</script></body>",
+		"<body><script>let s = '</body>';</script><S></body>"},
+	{"body end in textarea", BeforeBodyEnd, false,
+		"<body><textarea></body></TEXTAREA></body>",
+		"<body><textarea></body></TEXTAREA><S></body>"},
+	{"no body end", BeforeBodyEnd, false,
+		"<p>hi",
+		"<p>hi<S>"},
+	{"multi-byte before body end", BeforeBodyEnd, false,
+		"<body>\xe2\x98\x83</body>",
+		"<body>\xe2\x98\x83<S></body>"},
+
+	{"rewrite head tags", InHead, true,
+		"<head><meta charset=utf-8></head><body><meta name=x>",
+		"<head><S><meta data-marked charset=utf-8></head><body><meta name=x>"},
+	{"rewrite without head", InHead, true,
+		"<meta charset=utf-8><p><meta name=x>",
+		"<S><meta data-marked charset=utf-8><p><meta name=x>"},
+	{"rewrite after comment", BeforeBodyEnd, true,
+		"<!-- <meta> --><meta a><title><meta></title><meta b></body>",
+		"<!-- <meta> --><meta data-marked a><title><meta></title><meta data-marked b><S></body>"},
+	// Lowercasing invalid UTF-8 changes its length, so the end of raw text
+	// has to be found in the original bytes.
+	{"Latin-1 raw text", BeforeBodyEnd, true,
+		"<meta charset=windows-1252><title>caf\xe9 \xe9\xe9\xe9</TITLE><meta a><script>'\xe9\xe9\xe9\xe9\xe9\xe9\xe9\xe9'</script><meta b></body>",
+		"<meta data-marked charset=windows-1252><title>caf\xe9 \xe9\xe9\xe9</TITLE><meta data-marked a><script>'\xe9\xe9\xe9\xe9\xe9\xe9\xe9\xe9'</script><meta data-marked b><S></body>"},
+	{"Latin-1 body end", BeforeBodyEnd, true,
+		"<meta charset=iso-8859-1><style>p{content:'\xe0\xe8\xec'}</style></head><body><textarea>\xe9\xe9\xe9\xe9</textarea>\xe9</body>",
+		"<meta data-marked charset=iso-8859-1><style>p{content:'\xe0\xe8\xec'}</style></head><body><textarea>\xe9\xe9\xe9\xe9</textarea>\xe9<S></body>"},
+}
+
+func TestHTMLSuffixer(t *testing.T) {
+	for _, tt := range htmlSuffixerTests {
+		// Every chunk size, down to a byte at a time, should give the same
+		// result as the whole document at once.
+		for size := 1; size <= len(tt.in)+1; size++ {
+			suffixer := &HTMLSuffixer{
+				Suffix:    []byte("<S>"),
+				Placement: tt.placement,
+			}
+			if tt.rewrite {
+				suffixer.RewriteHeadTag = markMeta
+			}
+			var out []byte
+			for in := []byte(tt.in); len(in) > 0; {
+				n := size
+				if n > len(in) {
+					n = len(in)
+				}
+				out = append(out, suffixer.Tweak(in[:n])...)
+				in = in[n:]
+			}
+			out = append(out, suffixer.Tweak(nil)...)
+			if !bytes.Equal(out, []byte(tt.want)) {
+				t.Errorf("%s, in chunks of %d:\n got %q\nwant %q", tt.name, size, out, tt.want)
+				break
+			}
+		}
+	}
+}
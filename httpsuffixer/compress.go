@@ -0,0 +1,147 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpsuffixer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses known to be smaller than this aren't worth compressing.
+const minCompressSize = 256
+
+func compressible(contentType string) bool {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	switch contentType {
+	case "application/javascript", "application/json", "application/manifest+json",
+		"application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	request *http.Request
+
+	wroteHeader bool
+	encoder     flushWriteCloser
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	if statusCode < 200 {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if length, err := strconv.Atoi(h.Get("Content-Length")); statusCode == http.StatusOK &&
+		w.request.Method != http.MethodHead &&
+		h.Get("Content-Encoding") == "" &&
+		compressible(h.Get("Content-Type")) &&
+		(err != nil || length >= minCompressSize) {
+		if encoding := negotiateEncoding(w.request.Header.Get("Accept-Encoding")); encoding != "" {
+			h.Set("Content-Encoding", encoding)
+			h.Del("Content-Length")
+			h.Del("Accept-Ranges")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			w.encoder = newEncoder(encoding, w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok && w.encoder == nil {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+func (w *compressWriter) Flush() {
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	for p := w.ResponseWriter; p != nil; p = unwrap(p) {
+		if f, ok := p.(http.Flusher); ok {
+			f.Flush()
+			return
+		}
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	for p := w.ResponseWriter; p != nil; p = unwrap(p) {
+		if h, ok := p.(http.Hijacker); ok {
+			return h.Hijack()
+		}
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *compressWriter) close() {
+	if w.encoder != nil {
+		w.encoder.Close()
+	}
+}
+
+// Compress compresses responses from handler with Brotli or gzip when the
+// client says it can handle them. Responses that are already compressed,
+// partial, or not some kind of text are left alone.
+func Compress(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, request: r}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
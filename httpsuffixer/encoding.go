@@ -0,0 +1,123 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpsuffixer
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case "gzip", "x-gzip", "br", "deflate":
+		return true
+	}
+	return false
+}
+
+func decode(encoding string, data []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	case "deflate":
+		// "deflate" is supposed to mean zlib, but some servers send raw
+		// deflate data instead.
+		if r, err = zlib.NewReader(bytes.NewReader(data)); err != nil {
+			r, err = flate.NewReader(bytes.NewReader(data)), nil
+		}
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(encoding string, w io.Writer) flushWriteCloser {
+	switch encoding {
+	case "br":
+		return brotli.NewWriter(w)
+	case "deflate":
+		return zlib.NewWriter(w)
+	default:
+		return gzip.NewWriter(w)
+	}
+}
+
+func encode(encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	enc := newEncoder(encoding, &buf)
+	enc.Write(data)
+	enc.Close()
+	return buf.Bytes()
+}
+
+// negotiateEncoding picks the best encoding that an Accept-Encoding header
+// allows, or "" if it doesn't allow any.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		accepted[name] = q > 0
+	}
+	for _, encoding := range []string{"br", "gzip"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// FilterAcceptEncoding drops the encodings a SuffixServer can't decode from
+// an Accept-Encoding header, so that a server it wraps (like a proxy) sends
+// something that can be tweaked. If nothing is left, it returns "identity".
+func FilterAcceptEncoding(acceptEncoding string) string {
+	var kept []string
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		if supportedEncoding(name) || name == "identity" {
+			kept = append(kept, strings.TrimSpace(part))
+		}
+	}
+	if len(kept) == 0 {
+		return "identity"
+	}
+	return strings.Join(kept, ", ")
+}
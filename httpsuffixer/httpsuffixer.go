@@ -15,12 +15,25 @@
 package httpsuffixer
 
 import (
+	"bufio"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// Tweaked responses up to this size are held until they're complete, so
+// that they can be sent with a Content-Length.
+const DefaultBufferSize = 64 << 10
+
 type SuffixServer struct {
 	NewTweaker func(contentType string) Tweaker
+	// If set, NewRequestTweaker is used instead of NewTweaker. It can look at
+	// the request, and modify the response's headers before they're sent.
+	NewRequestTweaker func(r *http.Request, contentType string, header http.Header) Tweaker
+	// Defaults to DefaultBufferSize. Negative values turn off buffering.
+	BufferSize int
 }
 
 type Tweaker interface {
@@ -28,53 +41,210 @@ type Tweaker interface {
 }
 
 type responseWriter struct {
-	Server *SuffixServer
-	Parent http.ResponseWriter
+	Server  *SuffixServer
+	Parent  http.ResponseWriter
+	Request *http.Request
+
+	tweaker     Tweaker
+	wroteHeader bool
+	statusCode  int
+	// While buffering, the header hasn't been sent yet either.
+	buffering bool
+	buf       []byte
+	// The Content-Encoding of a compressed response that's being tweaked.
+	// The whole response is buffered, then decoded, tweaked, and encoded
+	// again at the end.
+	encoding string
+}
 
-	tweaker Tweaker
+func bodyAllowed(statusCode int) bool {
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
 }
 
 func (w *responseWriter) Header() http.Header {
 	return w.Parent.Header()
 }
 
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.Parent
+}
+
 func (w *responseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoding != "" {
+		w.buf = append(w.buf, data...)
+		return len(data), nil
+	}
 	oLen := len(data)
 	if w.tweaker != nil {
 		data = w.tweaker.Tweak(data)
 	}
-	bytesWritten, err := w.Parent.Write(data)
-	if err != nil {
-		return bytesWritten, err
+	if err := w.write(data); err != nil {
+		return 0, err
 	}
 	return oLen, nil
 }
 
+func (w *responseWriter) write(data []byte) error {
+	if w.buffering {
+		bufferSize := w.Server.BufferSize
+		if bufferSize == 0 {
+			bufferSize = DefaultBufferSize
+		}
+		if len(w.buf)+len(data) <= bufferSize {
+			w.buf = append(w.buf, data...)
+			return nil
+		}
+		if err := w.flushBuffer(false); err != nil {
+			return err
+		}
+	}
+	_, err := w.Parent.Write(data)
+	return err
+}
+
+// flushBuffer sends the header and anything buffered so far. If the body is
+// complete, it also sets Content-Length.
+func (w *responseWriter) flushBuffer(complete bool) error {
+	w.buffering = false
+	if complete {
+		w.Header().Set("Content-Length", strconv.Itoa(len(w.buf)))
+	}
+	w.Parent.WriteHeader(w.statusCode)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.Parent.Write(buf)
+	return err
+}
+
 func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	if statusCode < 200 {
+		// Informational responses come before the real one.
+		w.Parent.WriteHeader(statusCode)
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+
 	contentType := strings.SplitN(w.Parent.Header().Get("Content-Type"), ";", 2)[0]
-	if tweaker := w.Server.NewTweaker(contentType); tweaker != nil {
-		w.tweaker = tweaker
-		w.Header().Del("Content-Length") // TODO
+	var tweaker Tweaker
+	if w.Server.NewRequestTweaker != nil {
+		tweaker = w.Server.NewRequestTweaker(w.Request, contentType, w.Parent.Header())
+	} else {
+		tweaker = w.Server.NewTweaker(contentType)
+	}
+	encoding := strings.ToLower(w.Header().Get("Content-Encoding"))
+	if encoding == "identity" {
+		encoding = ""
+	}
+	// If the response is compressed in some way this can't decode, leave it
+	// alone instead of corrupting it.
+	if tweaker != nil && bodyAllowed(statusCode) && (encoding == "" || supportedEncoding(encoding)) {
+		// The length will change, and there's no body to tweak (and
+		// nothing should be added) for a HEAD request.
+		w.Header().Del("Content-Length")
+		if w.Request.Method != http.MethodHead {
+			w.tweaker = tweaker
+			w.encoding = encoding
+			w.buffering = encoding != "" || w.Server.BufferSize >= 0
+		}
+	}
+	if !w.buffering {
+		w.Parent.WriteHeader(statusCode)
 	}
-	w.Parent.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.Parent.(io.ReaderFrom); ok && w.tweaker == nil {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// unwrap returns the ResponseWriter that w wraps, if any. Optional
+// interfaces like http.Flusher are found by searching down the chain, the
+// same way http.ResponseController does.
+func unwrap(w http.ResponseWriter) http.ResponseWriter {
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		return u.Unwrap()
+	}
+	return nil
 }
 
 func (w *responseWriter) Flush() {
-	w.Parent.(http.Flusher).Flush()
+	if w.encoding != "" {
+		// Nothing can be sent until the whole response has been seen.
+		return
+	}
+	if w.buffering {
+		w.flushBuffer(false)
+	}
+	for p := w.Parent; p != nil; p = unwrap(p) {
+		if f, ok := p.(http.Flusher); ok {
+			f.Flush()
+			return
+		}
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	for p := w.Parent; p != nil; p = unwrap(p) {
+		if h, ok := p.(http.Hijacker); ok {
+			return h.Hijack()
+		}
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	for p := w.Parent; p != nil; p = unwrap(p) {
+		if pusher, ok := p.(http.Pusher); ok {
+			return pusher.Push(target, opts)
+		}
+	}
+	return http.ErrNotSupported
+}
+
+// finishEncoded decodes a compressed response, tweaks it, and compresses it
+// again. If it can't be decoded, it's sent as-is.
+func (w *responseWriter) finishEncoded() {
+	if body, err := decode(w.encoding, w.buf); err == nil {
+		tweaked := append([]byte{}, w.tweaker.Tweak(body)...)
+		tweaked = append(tweaked, w.tweaker.Tweak(nil)...)
+		w.buf = encode(w.encoding, tweaked)
+	}
+	w.flushBuffer(true)
 }
 
 func (w *responseWriter) Finish() {
-	if w.tweaker == nil {
+	if w.encoding != "" {
+		w.finishEncoded()
 		return
 	}
-	if trailer := w.tweaker.Tweak(nil); trailer != nil {
-		w.Parent.Write(trailer)
+	if w.tweaker != nil {
+		if trailer := w.tweaker.Tweak(nil); trailer != nil {
+			w.write(trailer)
+		}
+	}
+	if w.buffering {
+		w.flushBuffer(true)
 	}
 }
 
 func (s *SuffixServer) WrapServer(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		wrappedWriter := responseWriter{Server: s, Parent: w}
+		wrappedWriter := responseWriter{Server: s, Parent: w, Request: r}
 		handler.ServeHTTP(&wrappedWriter, r)
 		wrappedWriter.Finish()
 	})
@@ -0,0 +1,194 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ignore matches paths against patterns written like the ones in a
+// .gitignore file.
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// A Matcher holds a list of patterns. Later patterns take precedence over
+// earlier ones, so a negated pattern ("!keep.css") can re-include a path that
+// an earlier one excluded. The zero value matches nothing.
+type Matcher struct {
+	patterns []pattern
+}
+
+// Add adds one line of a .gitignore-style file. Blank lines and comments are
+// ignored.
+func (m *Matcher) Add(line string) {
+	if p, ok := compile(line); ok {
+		m.patterns = append(m.patterns, p)
+	}
+}
+
+// Read adds every line from r.
+func (m *Matcher) Read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m.Add(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// ReadFile adds every line from the file at path. A missing file isn't an
+// error, and adds nothing.
+func (m *Matcher) ReadFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.Read(f)
+}
+
+// Match reports whether path, a slash-separated path relative to the
+// directory the patterns came from, is ignored. Like git, it treats
+// everything inside an ignored directory as ignored.
+func (m *Matcher) Match(path string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	components := strings.Split(strings.Trim(path, "/"), "/")
+	for i := range components {
+		prefix := strings.Join(components[:i+1], "/")
+		if m.matchOne(prefix, isDir || i < len(components)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) matchOne(path string, isDir bool) bool {
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(path) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+func trimTrailingSpace(line string) string {
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+func compile(line string) (pattern, bool) {
+	var p pattern
+	line = strings.TrimSuffix(line, "\r")
+	line = trimTrailingSpace(line)
+	if line == "" || line[0] == '#' {
+		return p, false
+	}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but the end anchors the pattern to the directory
+	// it came from. Otherwise, it can match a name at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return p, false
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	rs := []rune(line)
+	startOfComponent := func(i int) bool {
+		return i == 0 || rs[i-1] == '/'
+	}
+	for i := 0; i < len(rs); {
+		rest := string(rs[i:])
+		switch c := rs[i]; {
+		case strings.HasPrefix(rest, "**/") && startOfComponent(i):
+			b.WriteString("(?:.*/)?")
+			i += 3
+		case rest == "**" && startOfComponent(i):
+			b.WriteString(".*")
+			i += 2
+		case c == '*':
+			b.WriteString("[^/]*")
+			i++
+		case c == '?':
+			b.WriteString("[^/]")
+			i++
+		case c == '[':
+			end := i + 1
+			if end < len(rs) && (rs[end] == '!' || rs[end] == '^') {
+				end++
+			}
+			if end < len(rs) && rs[end] == ']' {
+				end++
+			}
+			for end < len(rs) && rs[end] != ']' {
+				end++
+			}
+			if end >= len(rs) {
+				b.WriteString(`\[`)
+				i++
+				break
+			}
+			class := string(rs[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end + 1
+		case c == '\\' && i+1 < len(rs):
+			b.WriteString(regexp.QuoteMeta(string(rs[i+1])))
+			i += 2
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			i++
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return p, false
+	}
+	p.re = re
+	return p, true
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ignore
+
+import (
+	"strings"
+	"testing"
+)
+
+var matchTests = []struct {
+	name     string
+	patterns string
+	path     string
+	isDir    bool
+	want     bool
+}{
+	{"name", "a.txt", "a.txt", false, true},
+	{"name in subdirectory", "a.txt", "x/y/a.txt", false, true},
+	{"other name", "a.txt", "b.txt", false, false},
+	{"star", "*.css", "x/a.css", false, true},
+	{"star doesn't cross slashes", "x/*.css", "x/y/a.css", false, false},
+	{"question mark", "a?c", "abc", false, true},
+	{"question mark needs a character", "a?c", "ac", false, false},
+	{"class", "[ab].txt", "b.txt", false, true},
+	{"negated class", "[!ab].txt", "b.txt", false, false},
+	{"negated class, other", "[!ab].txt", "c.txt", false, true},
+	{"unclosed class", "[a", "[a", false, true},
+
+	{"leading **", "**/a.txt", "x/y/a.txt", false, true},
+	{"leading ** at top", "**/a.txt", "a.txt", false, true},
+	{"middle **", "x/**/a.txt", "x/y/z/a.txt", false, true},
+	{"middle ** matches nothing", "x/**/a.txt", "x/a.txt", false, true},
+	{"middle ** stays anchored", "x/**/a.txt", "y/x/a.txt", false, false},
+	{"trailing **", "x/**", "x/y/a.txt", false, true},
+	{"** in a name is a star", "a**.txt", "x/ab.txt", false, true},
+
+	{"negation", "*.css\n!keep.css", "keep.css", false, false},
+	{"negation of others", "*.css\n!keep.css", "other.css", false, true},
+	{"later patterns win", "!keep.css\n*.css", "keep.css", false, true},
+	{"negation inside ignored directory", "build/\n!build/keep.txt", "build/keep.txt", false, true},
+
+	{"directory only", "build/", "build", true, true},
+	{"directory only, file", "build/", "build", false, false},
+	{"directory only, inside", "build/", "x/build/a.txt", false, true},
+	{"inside ignored directory", "build", "build/x/a.txt", false, true},
+
+	{"leading slash anchors", "/a.txt", "a.txt", false, true},
+	{"leading slash anchors, deeper", "/a.txt", "x/a.txt", false, false},
+	{"middle slash anchors", "x/a.txt", "x/a.txt", false, true},
+	{"middle slash anchors, deeper", "x/a.txt", "y/x/a.txt", false, false},
+
+	{"escaped hash", `\#a`, "#a", false, true},
+	{"escaped bang", `\!a`, "!a", false, true},
+	{"escaped star", `a\*`, "a*", false, true},
+	{"escaped star is literal", `a\*`, "ab", false, false},
+	{"trailing space trimmed", "a.txt  ", "a.txt", false, true},
+	{"escaped trailing space", `a\ `, "a ", false, true},
+	{"escaped trailing space is kept", `a\ `, "a", false, false},
+	{"CRLF", "a.txt\r\n", "a.txt", false, true},
+
+	{"comment", "#a", "#a", false, false},
+	{"blank lines", "\n  \n", "a", false, false},
+	{"hash in pattern", "a#b", "a#b", false, true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, tt := range matchTests {
+		var m Matcher
+		if err := m.Read(strings.NewReader(tt.patterns)); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%s: %q matching %q (isDir %v) = %v, want %v", tt.name, tt.patterns, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestZeroMatcher(t *testing.T) {
+	var m *Matcher
+	if m.Match("a", false) {
+		t.Error("nil Matcher matched")
+	}
+	if (&Matcher{}).Match("a", false) {
+		t.Error("empty Matcher matched")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/skip2/go-qrcode"
+)
+
+var infoPageTemplate = template.Must(template.New("info").Parse(`<!DOCTYPE html>
+<meta name=viewport content="width=device-width">
+<title>reserve</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; }
+figure { display: inline-block; margin: 0 2em 2em 0; }
+img { display: block; width: 256px; image-rendering: pixelated; }
+</style>
+<p>Scan a code to open this server on another device.</p>
+{{range .}}<figure>
+<img src="{{.QR}}" alt="">
+<figcaption><a href="{{.URL}}">{{.URL}}</a></figcaption>
+</figure>
+{{end}}`))
+
+// serveInfoPage serves /.reserve/, which shows the server's URLs as QR
+// codes. Anyone with the access token gets URLs that include it.
+func (s *Server) serveInfoPage(w http.ResponseWriter, r *http.Request, readOnly bool) {
+	urls := s.URLs
+	if len(urls) == 0 {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		urls = []string{scheme + "://" + r.Host + "/"}
+	}
+	type entry struct {
+		URL string
+		QR  template.URL
+	}
+	var entries []entry
+	for _, u := range urls {
+		if s.AccessToken != "" && !readOnly {
+			if parsed, err := url.Parse(u); err == nil {
+				query := parsed.Query()
+				query.Set("token", s.AccessToken)
+				parsed.RawQuery = query.Encode()
+				u = parsed.String()
+			}
+		}
+		png, err := qrcode.Encode(u, qrcode.Medium, 256)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{u, template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	infoPageTemplate.Execute(w, entries)
+}
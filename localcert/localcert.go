@@ -0,0 +1,192 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package localcert makes certificates for development servers on a local
+// network, signed by a certificate authority of its own which browsers and
+// devices can be told to trust.
+package localcert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// The certificate authority. It's made once and kept, so that anything
+	// told to trust it keeps trusting the certificates it signs.
+	CAFile     = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+	caValidFor = 10 * 365 * 24 * time.Hour
+
+	// The server's certificate, made again whenever the hosts change.
+	certFile = "cert.pem"
+	keyFile  = "key.pem"
+	validFor = 365 * 24 * time.Hour
+
+	// Certificates which expire sooner than this are replaced.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// Load returns a certificate for hosts (names or IP addresses), signed by
+// the certificate authority in dir, which is made if needed. A certificate
+// cached in dir is reused if it covers all of the hosts and isn't about to
+// expire. Otherwise, a new one is made and cached there.
+func Load(dir string, hosts []string) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, caKey, err := loadCA(dir)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPath := filepath.Join(dir, certFile)
+	keyPath := filepath.Join(dir, keyFile)
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && covers(cert, ca, hosts) {
+		return cert, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template, err := newTemplate(validFor)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	certPEM, keyPEM, err := create(template, ca, key, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := write(certPath, keyPath, certPEM, keyPEM); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// loadCA loads the certificate authority from dir, or makes a new one if
+// there isn't one or it's about to expire.
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certPath := filepath.Join(dir, CAFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		key, ok := pair.PrivateKey.(crypto.Signer)
+		if err == nil && ok && ca.IsCA && time.Now().Add(renewBefore).Before(ca.NotAfter) {
+			return ca, key, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(caValidFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.Subject.CommonName = "reserve CA on " + template.Subject.CommonName
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	certPEM, keyPEM, err := create(template, template, key, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := write(certPath, keyPath, certPEM, keyPEM); err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+// covers reports whether cert was signed by ca and is good for a while
+// longer for all of hosts.
+func covers(cert tls.Certificate, ca *x509.Certificate, hosts []string) bool {
+	if len(cert.Certificate) == 0 {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.CheckSignatureFrom(ca) != nil ||
+		time.Now().Add(renewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func newTemplate(validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"reserve"},
+			CommonName:   hostname,
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(validFor),
+	}, nil
+}
+
+// create signs template with parent's key and returns it and key as PEM.
+func create(template, parent *x509.Certificate, key *ecdsa.PrivateKey, parentKey crypto.Signer) (certPEM, keyPEM []byte, err error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func write(certPath, keyPath string, certPEM, keyPEM []byte) error {
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, certPEM, 0644)
+}
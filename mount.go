@@ -0,0 +1,89 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Mount serves another directory (and watches it for changes) at a path
+// under the server's root, like a directory of shared assets at /lib/.
+type Mount struct {
+	Prefix string
+	Dir    http.Dir
+}
+
+type mountedDir struct {
+	// Always starts and ends with a slash.
+	prefix  string
+	dir     http.Dir
+	absPath string
+}
+
+// mountedDirs is sorted so that the first match for a path is the one with the
+// longest prefix. The root directory is last.
+type mountedDirs []*mountedDir
+
+func newMountedDirs(root http.Dir, mounts []Mount) mountedDirs {
+	var dirs mountedDirs
+	add := func(prefix string, dir http.Dir) {
+		absPath, _ := filepath.Abs(string(dir))
+		prefix = strings.TrimSuffix(path.Clean("/"+prefix), "/") + "/"
+		dirs = append(dirs, &mountedDir{prefix, dir, absPath})
+	}
+	for _, m := range mounts {
+		add(m.Prefix, m.Dir)
+	}
+	add("/", root)
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return len(dirs[i].prefix) > len(dirs[j].prefix)
+	})
+	return dirs
+}
+
+// find returns the directory that serves urlPath, and the path within it.
+func (dirs mountedDirs) find(urlPath string) (*mountedDir, string) {
+	for _, d := range dirs {
+		if strings.HasPrefix(urlPath, d.prefix) {
+			return d, "/" + strings.TrimPrefix(urlPath, d.prefix)
+		} else if urlPath+"/" == d.prefix {
+			return d, "/"
+		}
+	}
+	return dirs[len(dirs)-1], urlPath
+}
+
+func (dirs mountedDirs) fsPath(urlPath string) string {
+	d, rel := dirs.find(urlPath)
+	return filepath.Join(d.absPath, filepath.FromSlash(path.Clean(rel)))
+}
+
+func (dirs mountedDirs) Open(name string) (http.File, error) {
+	d, rel := dirs.find(name)
+	return d.dir.Open(rel)
+}
+
+// urlPath turns a path relative to this directory (as reported by its
+// watcher) into one relative to the root of the server.
+func (d *mountedDir) urlPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return strings.TrimPrefix(path.Join(d.prefix, p), "/")
+}
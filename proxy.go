@@ -0,0 +1,61 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/s4y/reserve/httpsuffixer"
+)
+
+// newProxy returns a handler which forwards requests to upstream. The Host
+// header is rewritten to match, since dev servers often check it, and only
+// compression that reserve can undo (to add its scripts) is offered.
+func newProxy(upstream *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		host := r.Host
+		director(r)
+		r.Header.Set("X-Forwarded-Host", host)
+		r.Host = upstream.Host
+		if values := r.Header.Values("Accept-Encoding"); len(values) > 0 {
+			r.Header.Set("Accept-Encoding", httpsuffixer.FilterAcceptEncoding(strings.Join(values, ",")))
+		}
+	}
+	return proxy
+}
+
+// servesLocally reports whether a request for fsPath should be answered
+// from disk instead of the upstream: it's a file, or a directory with an
+// index.html.
+func servesLocally(fsPath string) bool {
+	stat, err := os.Stat(fsPath)
+	if err != nil {
+		return false
+	}
+	if stat.IsDir() {
+		stat, err = os.Stat(filepath.Join(fsPath, "index.html"))
+		if err != nil {
+			return false
+		}
+	}
+	return stat.Mode().IsRegular()
+}
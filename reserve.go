@@ -16,10 +16,11 @@ package reserve
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -29,35 +30,11 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/s4y/reserve/httpsuffixer"
+	"github.com/s4y/reserve/ignore"
 	"github.com/s4y/reserve/static"
 	"github.com/s4y/reserve/watcher"
 )
 
-type HTMLSuffixer struct {
-	Suffix         []byte
-	sentScriptTags bool
-	buf            []byte
-}
-
-var doctypeMatcher = regexp.MustCompile(`^\s*<![^>\n]+>`)
-
-func (t *HTMLSuffixer) Tweak(data []byte) []byte {
-	if data != nil && !t.sentScriptTags {
-		t.buf = append(t.buf, data...)
-		if doctype := doctypeMatcher.Find(t.buf); doctype != nil {
-			t.sentScriptTags = true
-			return append(doctype, append(t.Suffix, t.buf[len(doctype):]...)...)
-		}
-		return nil
-	}
-	if !t.sentScriptTags {
-		data = append(t.Suffix, append(t.buf, data...)...)
-		t.sentScriptTags = true
-		t.buf = nil
-	}
-	return data
-}
-
 var gStaticFiles = map[string][]byte{
 	"/.reserve/reserve.js":         []byte(static.ReserveJs),
 	"/.reserve/reserve_modules.js": []byte(static.ReserveModulesJs),
@@ -99,63 +76,150 @@ func isHotModule(path string) bool {
 	return firstLine == "// reserve:hot_reload\n"
 }
 
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
-}
-
-type ClientConnections struct {
-	connections []chan func(*websocket.Conn)
-	lock        sync.Mutex
-}
-
-func (s *ClientConnections) add(c chan func(*websocket.Conn)) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.connections = append(s.connections, c)
-}
-
-func (s *ClientConnections) remove(c chan func(*websocket.Conn)) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	for i, cur_conn := range s.connections {
-		if cur_conn == c {
-			s.connections = append(s.connections[:i], s.connections[i+1:]...)
-			break
-		}
-	}
+// changeMessage is what clients hear about a change to a file. Affects lists
+// the (URL paths of) pages, stylesheets and scripts which were seen to refer
+// to it, directly or indirectly.
+type changeMessage struct {
+	watcher.Change
+	Affects []string `json:"affects,omitempty"`
 }
 
-func (s *ClientConnections) broadcast(message interface{}) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	for _, conn := range s.connections {
-		conn <- func(c *websocket.Conn) {
-			c.WriteJSON(message)
-		}
+func (s *Server) describeChange(change watcher.Change) changeMessage {
+	affects := s.deps.affected("/" + change.Path)
+	if change.From != "" {
+		affects = append(affects, s.deps.affected("/"+change.From)...)
 	}
+	return changeMessage{change, affects}
 }
 
 type Message struct {
 	Name  string      `json:"name"`
 	Value interface{} `json:"value"`
+	// For broadcasts, the channel the message was sent to.
+	Channel string `json:"channel,omitempty"`
+	// For direct messages, the IDs of the recipient and sender.
+	To   string `json:"to,omitempty"`
+	From string `json:"from,omitempty"`
+	// Set by a page on a request, and copied to the reply.
+	Ref int `json:"ref,omitempty"`
+	// An optional ID for a broadcast, passed along to the recipients.
+	ID string `json:"id,omitempty"`
+	// Don't send a broadcast back to the page that sent it.
+	ExcludeSelf bool `json:"excludeSelf,omitempty"`
+	// For changes to the shared state, which key to change and, optionally,
+	// the version the change is based on.
+	Key       string `json:"key,omitempty"`
+	IfVersion *int   `json:"ifVersion,omitempty"`
+	// Set on broadcasts replayed from the history when a page joins a
+	// channel.
+	History bool `json:"history,omitempty"`
 }
 
 type Server struct {
-	Dir       http.Dir
-	ReadStdin bool
+	Dir          http.Dir
+	ReadStdin    bool
+	WatchOptions watcher.Options
+	// Also skip changes to files matched by the .gitignore at the top of Dir,
+	// in addition to .reserveignore.
+	Gitignore bool
+	// Other directories to serve and watch alongside Dir.
+	Mounts []Mount
+	// Compress responses for clients that support it.
+	Compress bool
+	// Where to add reserve's scripts to HTML pages.
+	ScriptPlacement Placement
+	// If set, requests for paths that don't exist in Dir (or a mount) are
+	// forwarded to Proxy, and reserve's scripts are added to any HTML it
+	// sends back.
+	Proxy *url.URL
+	// If set, the shared state and broadcast history are saved to this file,
+	// and loaded from it on start.
+	StorePath string
+	// How many broadcasts to each channel to keep, to replay to pages that
+	// join the channel later.
+	HistorySize int
+	// How many messages can wait to be sent to a page that isn't keeping up,
+	// and what happens after that. Defaults to DefaultClientQueueSize.
+	ClientQueueSize int
+	OverflowPolicy  OverflowPolicy
+	// How long sending one message to a page can take before it's
+	// disconnected. Defaults to DefaultWriteTimeout.
+	WriteTimeout time.Duration
+	// The biggest message, in bytes, a page can send. Defaults to
+	// DefaultMaxMessageSize. Negative values turn off the limit.
+	MaxMessageSize int64
+	// How many messages to other pages (broadcasts, direct messages, and
+	// changes to metadata or the shared state) a page can send per second,
+	// and in a burst. Defaults to DefaultBroadcastRate and
+	// DefaultBroadcastBurst. A negative rate turns off the limit.
+	BroadcastRate  float64
+	BroadcastBurst int
+	// If set, only people with AccessToken can use the server. It's passed
+	// as ?token= once, and then kept in a cookie.
+	AccessToken string
+	// With an AccessToken, let anyone load pages and receive messages, but
+	// not send them.
+	ReadOnlyViewers bool
+	// Pages on these origins (like "https://example.com"), as well as
+	// reserve's own, can connect to /.reserve/ws. "*" allows any origin.
+	AllowedOrigins []string
+	// The URLs the server can be reached at, for /.reserve/ to show as QR
+	// codes. Defaults to the URL that page was loaded from.
+	URLs []string
+
+	handler   http.Handler
+	startLock sync.Mutex
+	conns     *ClientConnections
+	state     stateStore
+	history   history
+	saver     *saver
+	dirs      mountedDirs
+	deps      dependencies
+	watchers  []*watcher.Watcher
+
+	ignore     *ignore.Matcher
+	ignoreLock sync.Mutex
+}
+
+func isIgnoreFile(p string) bool {
+	return p == ".reserveignore" || p == ".gitignore"
+}
 
-	handler http.Handler
+func (s *Server) loadIgnores(absPath string) {
+	var m ignore.Matcher
+	if s.Gitignore {
+		m.ReadFile(filepath.Join(absPath, ".gitignore"))
+	}
+	m.ReadFile(filepath.Join(absPath, ".reserveignore"))
+	s.ignoreLock.Lock()
+	defer s.ignoreLock.Unlock()
+	s.ignore = &m
 }
 
-func wrapConnection(c *websocket.Conn) chan func(*websocket.Conn) {
-	ch := make(chan func(*websocket.Conn), 16)
-	go func() {
-		for f := range ch {
-			f(c)
+func (s *Server) isIgnored(p string, isDir bool) bool {
+	s.ignoreLock.Lock()
+	m := s.ignore
+	s.ignoreLock.Unlock()
+	return m.Match(p, isDir)
+}
+
+// filterIgnored drops a change if it's to an ignored file. A file renamed
+// into or out of an ignored location looks like it was removed or created.
+func (s *Server) filterIgnored(change watcher.Change) (watcher.Change, bool) {
+	// The path may not be there any more to check whether it's a directory.
+	isIgnored := func(p string) bool {
+		return s.isIgnored(p, change.IsDir)
+	}
+	if isIgnored(change.Path) {
+		if change.Kind != watcher.Renamed || isIgnored(change.From) {
+			return change, false
 		}
-	}()
-	return ch
+		return watcher.Change{Kind: watcher.Removed, Path: change.From, IsDir: change.IsDir}, true
+	}
+	if change.Kind == watcher.Renamed && isIgnored(change.From) {
+		return watcher.Change{Kind: watcher.Created, Path: change.Path, Hash: change.Hash, IsDir: change.IsDir}, true
+	}
+	return change, true
 }
 
 type minLastModifiedResponseWriter struct {
@@ -164,6 +228,10 @@ type minLastModifiedResponseWriter struct {
 
 var startupTime = time.Time.Round(time.Now().UTC(), time.Second)
 
+func (w *minLastModifiedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (w *minLastModifiedResponseWriter) WriteHeader(statusCode int) {
 	if lm, err := time.Parse(http.TimeFormat, w.Header().Get("Last-Modified")); err != nil || lm.Before(startupTime) {
 		w.Header().Set("Last-Modified", startupTime.Format(http.TimeFormat))
@@ -202,31 +270,138 @@ func serveJSONDirectoryListing(path string, w http.ResponseWriter, r *http.Reque
 	return json.NewEncoder(w).Encode(fileInfos)
 }
 
-func (s *Server) start() {
-	upgrader := websocket.Upgrader{}
-	conns := ClientConnections{}
+func (s *Server) start() error {
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	// Allocated on its own so that its metrics are aligned for atomic
+	// access, wherever the Server is.
+	conns := new(ClientConnections)
+	s.conns = conns
+	conns.queueSize = s.ClientQueueSize
+	if conns.queueSize <= 0 {
+		conns.queueSize = DefaultClientQueueSize
+	}
+	conns.overflow = s.OverflowPolicy
+	conns.state = &s.state
+	conns.writeTimeout = s.WriteTimeout
+	if conns.writeTimeout <= 0 {
+		conns.writeTimeout = DefaultWriteTimeout
+	}
 
 	suffixer := httpsuffixer.SuffixServer{
-		NewTweaker: func(content_type string) httpsuffixer.Tweaker {
-			switch content_type {
+		NewRequestTweaker: func(r *http.Request, contentType string, header http.Header) httpsuffixer.Tweaker {
+			scanner := &dependencyScanner{
+				deps: &s.deps,
+				base: &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path},
+			}
+			switch contentType {
 			case "text/html":
+				nonce := newNonce()
+				allowReserveInHeader(header, nonce, r.Host)
+				// Each response gets its own nonce, so a cached copy can't
+				// be revalidated: a 304 would come with the upstream's
+				// Content-Security-Policy, without the nonce.
+				header.Del("ETag")
+				header.Del("Last-Modified")
 				// Slice to remove trailing newline
-				return &HTMLSuffixer{Suffix: []byte(static.FilterHtml[:len(static.FilterHtml)-1])}
+				suffix := []byte(static.FilterHtml[:len(static.FilterHtml)-1])
+				scanner.next = &HTMLSuffixer{
+					Suffix:         bytes.ReplaceAll(suffix, []byte("<script "), []byte(`<script nonce="`+nonce+`" `)),
+					Placement:      s.ScriptPlacement,
+					RewriteHeadTag: allowReserveInMetaTag(nonce, r.Host),
+				}
+				scanner.matchers = []*regexp.Regexp{htmlRefMatcher, cssRefMatcher, jsRefMatcher}
+			case "text/css":
+				scanner.matchers = []*regexp.Regexp{cssRefMatcher}
+			case "text/javascript", "application/javascript":
+				scanner.matchers = []*regexp.Regexp{jsRefMatcher}
 			default:
 				return nil
 			}
+			return scanner
 		}}
 
-	absPath, _ := filepath.Abs(string(s.Dir))
-	watcher := watcher.NewWatcher(absPath)
-	go func() {
-		for change := range watcher.Changes {
-			conns.broadcast(Message{
-				Name:  "change",
-				Value: change,
-			})
+	s.dirs = newMountedDirs(s.Dir, s.Mounts)
+	root := s.dirs[len(s.dirs)-1]
+	absPath := root.absPath
+	s.loadIgnores(absPath)
+	closeWatchers := func() {
+		for _, w := range s.watchers {
+			w.Close()
+		}
+		s.watchers = nil
+	}
+	var storeFiles map[string]bool
+	if s.StorePath != "" {
+		storeFiles = storeFilePaths(s.StorePath)
+	}
+	for _, d := range s.dirs {
+		d := d
+		// Watchers report paths relative to the directory with symlinks
+		// resolved.
+		realPath, err := filepath.EvalSymlinks(d.absPath)
+		if err != nil {
+			realPath = d.absPath
+		}
+		watchOptions := s.WatchOptions
+		if include := watchOptions.Include; include != nil {
+			watchOptions.Include = func(p string) bool {
+				return (d == root && isIgnoreFile(p)) || include(p)
+			}
 		}
-	}()
+		exclude := watchOptions.Exclude
+		if exclude == nil {
+			exclude = watcher.DefaultExclude
+		}
+		watchOptions.Exclude = func(p string) bool {
+			if d == root && isIgnoreFile(p) {
+				return false
+			}
+			// Saving the store shouldn't look like a change to the project.
+			if storeFiles[filepath.Join(realPath, filepath.FromSlash(p))] {
+				return true
+			}
+			return exclude(p)
+		}
+		// Don't spend time on ignored trees, like node_modules.
+		watchOptions.Ignore = func(p string, isDir bool) bool {
+			return !(d == root && isIgnoreFile(p)) && s.isIgnored(d.urlPath(p), isDir)
+		}
+		watcher, err := watcher.NewWatcher(d.absPath, watchOptions)
+		if err != nil {
+			closeWatchers()
+			return err
+		}
+		s.watchers = append(s.watchers, watcher)
+		go func(d *mountedDir) {
+			for change := range watcher.Changes {
+				if d == root && isIgnoreFile(change.Path) {
+					s.loadIgnores(absPath)
+					continue
+				}
+				change.Path = d.urlPath(change.Path)
+				change.From = d.urlPath(change.From)
+				change, ok := s.filterIgnored(change)
+				if !ok {
+					continue
+				}
+				conns.broadcast(Message{
+					Name:  "change",
+					Value: s.describeChange(change),
+				})
+			}
+		}(d)
+	}
+
+	// Loaded once the watchers are running, so that there's nothing to clean
+	// up if one fails to start.
+	s.history.size = s.HistorySize
+	if s.StorePath != "" {
+		if err := s.loadStore(); err != nil {
+			closeWatchers()
+			return err
+		}
+		s.startSaving()
+	}
 
 	if s.ReadStdin {
 		go func() {
@@ -241,7 +416,7 @@ func (s *Server) start() {
 		}()
 	}
 
-	fileServer := ensureMinLastModifiedTime(http.FileServer(s.Dir))
+	fileServer := ensureMinLastModifiedTime(http.FileServer(s.dirs))
 	suffixServer := suffixer.WrapServer(fileServer)
 	server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
@@ -252,51 +427,50 @@ func (s *Server) start() {
 		}
 	})
 
+	var proxy, proxySuffixServer http.Handler
+	if s.Proxy != nil {
+		proxy = newProxy(s.Proxy)
+		proxySuffixServer = suffixer.WrapServer(proxy)
+	}
+
 	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, readOnly := s.checkAccess(w, r)
+		if !ok {
+			return
+		}
 
 		// Will be overridden (above) for regular files
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 
-		fsPath := path.Join(absPath, r.URL.Path)
+		fsPath := s.dirs.fsPath(r.URL.Path)
 		if r.URL.Path == "/.reserve/ws" {
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
 				return
 			}
-			defer conn.Close()
-			ch := wrapConnection(conn)
-			defer close(ch)
-			conns.add(ch)
-			defer conns.remove(ch)
-			for {
-				var msg Message
-				if err := conn.ReadJSON(&msg); err != nil {
-					break
-				}
-				switch msg.Name {
-				case "broadcast":
-					conns.broadcast(msg)
-				case "ping":
-					startTime, _ := msg.Value.(float64)
-					ch <- func(conn *websocket.Conn) {
-						conn.WriteJSON(Message{"pong", struct {
-							StartTime  float64 `json:"startTime"`
-							ServerTime int64   `json:"serverTime"`
-						}{startTime, time.Now().UnixNano() / int64(time.Millisecond)}})
-					}
-				default:
-					continue
-				}
-			}
+			s.serveClient(conn, r, readOnly)
 			return
 		} else if _, exists := r.URL.Query()["raw"]; !exists && isHotModule(fsPath) {
 			w.Header().Set("Content-Type", "application/javascript")
 			w.Write([]byte(jsWrapper(r.URL.Path)))
 		} else if staticContent, ok := gStaticFiles[r.URL.Path]; ok {
 			http.ServeContent(w, r, r.URL.Path, static.ModTime, strings.NewReader(string(staticContent)))
-		} else if r.URL.Path == "/.reserveignore" && !fileExists(fsPath) {
-			// Suppress 404s in the browser console
-			w.Write([]byte{})
+		} else if r.URL.Path == "/.reserve/metrics" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(conns.report())
+		} else if r.URL.Path == "/.reserve/" {
+			s.serveInfoPage(w, r, readOnly)
+		} else if strings.HasPrefix(r.URL.Path, "/.reserve/") {
+			// Reserve's own files, like the store, aren't for serving.
+			http.NotFound(w, r)
+		} else if proxy != nil && !servesLocally(fsPath) {
+			// The upstream decides how its responses are cached.
+			w.Header().Del("Cache-Control")
+			if r.Header.Get("Upgrade") != "" {
+				proxy.ServeHTTP(w, r)
+			} else {
+				proxySuffixServer.ServeHTTP(w, r)
+			}
 		} else {
 			wantHTML := false
 			if acceptHeader := r.Header.Get("Accept"); acceptHeader != "" {
@@ -321,11 +495,58 @@ func (s *Server) start() {
 			server.ServeHTTP(w, r)
 		}
 	})
+	if s.Compress {
+		s.handler = httpsuffixer.Compress(s.handler)
+	}
+	return nil
+}
+
+// Start starts watching Dir for changes. It's called by the first request if
+// needed, but calling it first lets the caller handle errors.
+func (s *Server) Start() error {
+	s.startLock.Lock()
+	defer s.startLock.Unlock()
+	if s.handler != nil {
+		return nil
+	}
+	return s.start()
+}
+
+// Close stops watching for changes and disconnects all clients.
+func (s *Server) Close() error {
+	s.startLock.Lock()
+	defer s.startLock.Unlock()
+	var err error
+	for _, w := range s.watchers {
+		if closeErr := w.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	s.watchers = nil
+	if s.conns != nil {
+		s.conns.closeAll()
+	}
+	s.stopSaving()
+	return err
+}
+
+// Polling reports whether the server is scanning for changes because
+// filesystem notifications aren't available (or WatchOptions asked it to).
+func (s *Server) Polling() bool {
+	s.startLock.Lock()
+	defer s.startLock.Unlock()
+	for _, w := range s.watchers {
+		if w.Polling() {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if s.handler == nil {
-		s.start()
+	if err := s.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	s.handler.ServeHTTP(w, r)
 }
@@ -15,27 +15,344 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/s4y/reserve"
+	"github.com/s4y/reserve/localcert"
+	"github.com/s4y/reserve/watcher"
+	"github.com/skip2/go-qrcode"
 )
 
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// matchesAny reports whether p, or any directory that contains it, matches
+// one of patterns. Patterns without a slash are matched against names.
+func matchesAny(patterns []string, p string) bool {
+	for ; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			target := p
+			if !strings.Contains(pattern, "/") {
+				target = path.Base(p)
+			}
+			if ok, _ := path.Match(pattern, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomToken() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// localHosts lists the names and addresses this computer might be reached
+// at.
+func localHosts() []string {
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+		if !strings.Contains(hostname, ".") {
+			hosts = append(hosts, hostname+".local")
+		}
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+	return hosts
+}
+
+// lanAddresses lists this computer's IPv4 addresses, other than loopback.
+func lanAddresses() []net.IP {
+	var ips []net.IP
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// serverURLs lists URLs for a server listening on addr. If it's listening
+// on all interfaces, that's localhost and then each LAN address.
+func serverURLs(scheme string, addr net.Addr) []string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	format := func(host string) string {
+		return (&url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port), Path: "/"}).String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsUnspecified() {
+		return []string{format(host)}
+	}
+	urls := []string{format("localhost")}
+	for _, ip := range lanAddresses() {
+		urls = append(urls, format(ip.String()))
+	}
+	return urls
+}
+
+// remoteURL returns the first of urls which other devices might be able to
+// reach, or "" if they're all loopback addresses.
+func remoteURL(urls []string) string {
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		host := parsed.Hostname()
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return u
+		}
+	}
+	return ""
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// localCert loads or makes a certificate for every address this computer
+// has, cached in the user's cache directory along with the certificate
+// authority that signs it, whose path it also returns.
+func localCert() (tls.Certificate, string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	dir := filepath.Join(cacheDir, "reserve")
+	cert, err := localcert.Load(dir, localHosts())
+	return cert, filepath.Join(dir, localcert.CAFile), err
+}
+
+// serveRedirect listens for plain HTTP on addr and sends everything to the
+// same place on the HTTPS server at httpsAddr.
+func serveRedirect(addr string, httpsAddr net.Addr) {
+	_, port, _ := net.SplitHostPort(httpsAddr.String())
+	log.Fatal(http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		if port != "443" {
+			u.Host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	})))
+}
+
 func main() {
 	httpAddr := flag.String("http", "127.0.0.1:8080", "Listening address")
 	readStdin := flag.Bool("stdin", false, "Read standard input and fire \"stdin\" JavaScript events for each line")
+	debounce := flag.Duration("debounce", watcher.DefaultQuiet, "How long to wait for file changes to settle before reloading")
+	debounceMax := flag.Duration("debounce-max", watcher.DefaultMaxWait, "The longest to put off reloading while files keep changing")
+	poll := flag.Bool("poll", false, "Scan for changes instead of relying on filesystem notifications (for network mounts and such)")
+	pollInterval := flag.Duration("poll-interval", watcher.DefaultPollInterval, "How often to scan for changes when polling")
+	compress := flag.Bool("compress", true, "Compress responses for browsers that support it")
+	inject := flag.String("inject", "head", "Where to add reserve's scripts to pages: \"head\" or \"body\" (before </body>)")
+	gitignore := flag.Bool("gitignore", false, "Also ignore changes to files matched by .gitignore")
+	proxy := flag.String("proxy", "", "Forward requests for files that don't exist to this URL, like http://localhost:3000")
+	persist := flag.Bool("persist", false, "Save shared state and broadcast history, and load them again on start")
+	storePath := flag.String("store", filepath.Join(".reserve", "store.json"), "Where -persist saves things")
+	historySize := flag.Int("history", 0, "How many broadcasts to each channel to replay to pages that join it")
+	queueSize := flag.Int("queue-size", reserve.DefaultClientQueueSize, "How many messages can wait to be sent to a page that's falling behind")
+	overflow := flag.String("overflow", "drop-oldest", "What to do when a page falls further behind: \"drop-oldest\", \"drop-newest\", or \"disconnect\"")
+	writeTimeout := flag.Duration("write-timeout", reserve.DefaultWriteTimeout, "Disconnect a page if sending it a message takes longer than this")
+	maxMessageSize := flag.Int64("max-message-size", reserve.DefaultMaxMessageSize, "The biggest message, in bytes, a page can send (-1 for no limit)")
+	broadcastRate := flag.Float64("broadcast-rate", reserve.DefaultBroadcastRate, "How many messages to other pages (broadcasts, direct messages, state changes) a page can send per second, on average (-1 for no limit)")
+	broadcastBurst := flag.Int("broadcast-burst", reserve.DefaultBroadcastBurst, "How many messages to other pages a page can send at once")
+	auth := flag.Bool("auth", false, "Only let people with a secret link use the server")
+	token := flag.String("token", "", "Use this as the secret for -auth, instead of a random one")
+	readOnlyViewers := flag.Bool("read-only-viewers", false, "With -auth, let anyone view pages, but only people with the link send messages")
+	https := flag.Bool("https", false, "Serve HTTPS, with a certificate from a local certificate authority unless -cert and -key are given")
+	certFile := flag.String("cert", "", "Certificate file for -https")
+	keyFile := flag.String("key", "", "Private key file for -https")
+	httpRedirect := flag.String("http-redirect", "", "With -https, also listen for plain HTTP on this address, like :8081, and redirect to HTTPS")
+	qr := flag.Bool("qr", true, "Print a QR code for opening the server on a phone")
+	var includes, excludes, mounts, origins stringsFlag
+	flag.Var(&origins, "allow-origin", "Also let pages from this origin, like https://example.com, connect for messages (repeatable)")
+	flag.Var(&includes, "include", "Only watch files matching this glob (repeatable)")
+	flag.Var(&excludes, "exclude", "Don't watch files matching this glob (repeatable)")
+	flag.Var(&mounts, "mount", "Also serve and watch a directory at a path, like /lib/=../shared (repeatable)")
 	flag.Parse()
-	fmt.Printf("http://%s/\n", *httpAddr)
+	if *token != "" {
+		*auth = true
+	} else if *auth {
+		*token = randomToken()
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		log.Fatal("-cert and -key go together")
+	} else if *certFile != "" {
+		*https = true
+	}
 
 	ln, err := net.Listen("tcp", *httpAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	scheme := "http"
+	if *https {
+		scheme = "https"
+	}
+	urls := serverURLs(scheme, ln.Addr())
+	for _, u := range urls {
+		if *auth {
+			u += "?token=" + url.QueryEscape(*token)
+		}
+		fmt.Println(u)
+	}
+	if u := remoteURL(urls); *qr && u != "" && isTerminal(os.Stdout) {
+		if *auth {
+			u += "?token=" + url.QueryEscape(*token)
+		}
+		if code, err := qrcode.New(u, qrcode.Low); err == nil {
+			fmt.Print(code.ToSmallString(false))
+		}
+	}
+	if *https {
+		var cert tls.Certificate
+		if *certFile != "" {
+			cert, err = tls.LoadX509KeyPair(*certFile, *keyFile)
+		} else {
+			var caPath string
+			cert, caPath, err = localCert()
+			if err == nil {
+				fmt.Printf("To skip certificate warnings, tell your browser or device to trust %s\n", caPath)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if *httpRedirect != "" {
+			go serveRedirect(*httpRedirect, ln.Addr())
+		}
+	}
 
 	server := reserve.FileServer(".")
 	server.ReadStdin = *readStdin
+	server.Gitignore = *gitignore
+	server.Compress = *compress
+	server.HistorySize = *historySize
+	if *persist {
+		server.StorePath = *storePath
+	}
+	switch *inject {
+	case "head":
+		server.ScriptPlacement = reserve.InHead
+	case "body":
+		server.ScriptPlacement = reserve.BeforeBodyEnd
+	default:
+		log.Fatalf("-inject should be \"head\" or \"body\", not %q", *inject)
+	}
+	if *proxy != "" {
+		u, err := url.Parse(*proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("-proxy should be an http:// or https:// URL, not %q", *proxy)
+		}
+		server.Proxy = u
+	}
+	server.ClientQueueSize = *queueSize
+	server.WriteTimeout = *writeTimeout
+	if *auth {
+		server.AccessToken = *token
+		server.ReadOnlyViewers = *readOnlyViewers
+	}
+	server.AllowedOrigins = origins
+	server.URLs = urls
+	server.MaxMessageSize = *maxMessageSize
+	server.BroadcastRate = *broadcastRate
+	server.BroadcastBurst = *broadcastBurst
+	switch *overflow {
+	case "drop-oldest":
+		server.OverflowPolicy = reserve.DropOldest
+	case "drop-newest":
+		server.OverflowPolicy = reserve.DropNewest
+	case "disconnect":
+		server.OverflowPolicy = reserve.Disconnect
+	default:
+		log.Fatalf("-overflow should be \"drop-oldest\", \"drop-newest\", or \"disconnect\", not %q", *overflow)
+	}
+	for _, mount := range mounts {
+		parts := strings.SplitN(mount, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("-mount should look like /path/=directory, not %q", mount)
+		}
+		server.Mounts = append(server.Mounts, reserve.Mount{
+			Prefix: parts[0],
+			Dir:    http.Dir(parts[1]),
+		})
+	}
+	server.WatchOptions = watcher.Options{
+		Quiet:        *debounce,
+		MaxWait:      *debounceMax,
+		Poll:         *poll,
+		PollInterval: *pollInterval,
+		Exclude: func(p string) bool {
+			return watcher.DefaultExclude(p) || matchesAny(excludes, p)
+		},
+	}
+	if len(includes) > 0 {
+		server.WatchOptions.Include = func(p string) bool {
+			return matchesAny(includes, p)
+		}
+	}
+	if err := server.Start(); err != nil {
+		log.Fatal(err)
+	}
+	if server.Polling() && !*poll {
+		log.Printf("File change notifications aren't available; polling every %v instead", *pollInterval)
+	}
+	// Save the store before exiting.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		server.Close()
+		os.Exit(0)
+	}()
 	log.Fatal(http.Serve(ln, server))
 }
@@ -0,0 +1,159 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"errors"
+	"sync"
+)
+
+// A stateStore holds JSON values, by key, which pages share. Every change
+// bumps its version, so that pages can make changes conditional on not
+// having missed any.
+type stateStore struct {
+	lock    sync.Mutex
+	version int
+	// Values are never modified once stored, so they can be handed out
+	// without copying.
+	values map[string]interface{}
+}
+
+// stateSnapshot is the whole state, as sent to pages when they connect.
+type stateSnapshot struct {
+	Version int                    `json:"version"`
+	Values  map[string]interface{} `json:"values"`
+}
+
+// stateChange tells pages about one change to the state.
+type stateChange struct {
+	Version int                    `json:"version"`
+	Set     map[string]interface{} `json:"set,omitempty"`
+	Deleted []string               `json:"deleted,omitempty"`
+}
+
+var (
+	errStateConflict = errors.New("the state has changed")
+	errStateInvalid  = errors.New("state changes need a key, and patches without one need an object")
+)
+
+func (st *stateStore) snapshot() stateSnapshot {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.snapshotLocked()
+}
+
+func (st *stateStore) snapshotLocked() stateSnapshot {
+	values := make(map[string]interface{}, len(st.values))
+	for k, v := range st.values {
+		values[k] = v
+	}
+	return stateSnapshot{st.version, values}
+}
+
+// withSnapshot calls f with a snapshot of the state. No changes are made
+// until f returns, so a page can start listening for them without missing
+// any or hearing about them before the snapshot.
+func (st *stateStore) withSnapshot(f func(stateSnapshot)) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	f(st.snapshotLocked())
+}
+
+func (st *stateStore) restore(snapshot stateSnapshot) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.version = snapshot.Version
+	st.values = snapshot.Values
+}
+
+// update calls f with the current values and a change to fill in, then
+// applies the change and passes it to publish before any other change can be
+// made, so that pages hear about changes in order. If ifVersion is set and
+// the state's version is different, nothing happens and update returns
+// errStateConflict.
+func (st *stateStore) update(ifVersion *int, f func(values map[string]interface{}, change *stateChange), publish func(stateChange)) (stateChange, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if ifVersion != nil && *ifVersion != st.version {
+		return stateChange{}, errStateConflict
+	}
+	if st.values == nil {
+		st.values = make(map[string]interface{})
+	}
+	change := stateChange{Set: make(map[string]interface{})}
+	f(st.values, &change)
+	for k, v := range change.Set {
+		st.values[k] = v
+	}
+	for _, k := range change.Deleted {
+		delete(st.values, k)
+	}
+	st.version++
+	change.Version = st.version
+	publish(change)
+	return change, nil
+}
+
+// mergePatch applies a JSON merge patch (RFC 7396) to target. target isn't
+// modified; anything that changes is copied.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, _ := target.(map[string]interface{})
+	result := make(map[string]interface{}, len(t))
+	for k, v := range t {
+		result[k] = v
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = mergePatch(result[k], v)
+		}
+	}
+	return result
+}
+
+// handleMessage applies a state-set, state-patch or state-delete message
+// from a page, and passes the change to publish. A patch without a key
+// applies to the whole state.
+func (st *stateStore) handleMessage(msg Message, publish func(stateChange)) (stateChange, error) {
+	if msg.Key == "" {
+		if _, ok := msg.Value.(map[string]interface{}); msg.Name != "state-patch" || !ok {
+			return stateChange{}, errStateInvalid
+		}
+	}
+	return st.update(msg.IfVersion, func(values map[string]interface{}, change *stateChange) {
+		switch {
+		case msg.Name == "state-set":
+			change.Set[msg.Key] = msg.Value
+		case msg.Name == "state-delete":
+			change.Deleted = append(change.Deleted, msg.Key)
+		case msg.Name == "state-patch" && msg.Key != "":
+			change.Set[msg.Key] = mergePatch(values[msg.Key], msg.Value)
+		case msg.Name == "state-patch":
+			patch, _ := msg.Value.(map[string]interface{})
+			for k, v := range patch {
+				if v == nil {
+					change.Deleted = append(change.Deleted, k)
+				} else {
+					change.Set[k] = mergePatch(values[k], v)
+				}
+			}
+		}
+	}, publish)
+}
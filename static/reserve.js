@@ -26,38 +26,6 @@ window.__reserve_hooks_by_extension = {
 };
 
 (() => {
-  const ignorePats = [];
-  const shouldIgnore = path => {
-    for (const pat of ignorePats) {
-      if (pat[0] == '/' && path.startsWith(pat))
-        return true;
-    }
-    return false;
-  };
-  const reloadIgnoreFile = () => {
-    fetch('/.reserveignore')
-      .then(r => r.text())
-      .then(text => {
-        ignorePats.length = 0;
-        for (const pat of text.split('\n')) {
-          if (pat)
-            ignorePats.push(pat);
-        }
-      });
-  };
-  reloadIgnoreFile();
-
-  window.addEventListener('sourcechange', e => {
-    const changedPath = new URL(e.detail, location.href).pathname;
-    if (changedPath == '/.reserveignore') {
-      reloadIgnoreFile();
-      e.preventDefault();
-      return;
-    } else if (shouldIgnore(changedPath)) {
-      e.preventDefault();
-    }
-  });
-
   const defaultHook = f => new_f => {
     let handled = false;
     for (let el of document.querySelectorAll('link')) {
@@ -76,27 +44,169 @@ window.__reserve_hooks_by_extension = {
     }
     return handled;
   };
+  const moveHook = (from, to) => new_f => {
+    let handled = false;
+    for (let el of document.querySelectorAll('link')) {
+      if (el.href != from && el.dataset.ohref != from)
+        continue;
+      el.dataset.ohref = to;
+      el.href = new_f;
+      handled = true;
+    }
+    return handled;
+  };
   const hooks = {};
-  const cacheBustQuery = () => `?cache_bust=${+new Date}`;
+  const cacheBustQuery = hash => `?cache_bust=${hash || +new Date}`;
+
+  // Broadcasts go to the page's own path unless they name another channel.
+  const pageChannel = location.pathname;
+  const channels = new Set([pageChannel]);
+
+  // Binary messages are sent as a header (a message without a value, as
+  // JSON), preceded by its length as two bytes, and then the payload.
+  const encodeFrame = (message, payload) => {
+    const header = new TextEncoder().encode(JSON.stringify(message));
+    const bytes = ArrayBuffer.isView(payload) ?
+      new Uint8Array(payload.buffer, payload.byteOffset, payload.byteLength) :
+      new Uint8Array(payload);
+    const frame = new Uint8Array(2 + header.length + bytes.length);
+    new DataView(frame.buffer).setUint16(0, header.length);
+    frame.set(header, 2);
+    frame.set(bytes, 2 + header.length);
+    return frame;
+  };
+  const decodeFrame = buffer => {
+    const length = new DataView(buffer).getUint16(0);
+    const header = JSON.parse(new TextDecoder().decode(new Uint8Array(buffer, 2, length)));
+    return { ...header, value: buffer.slice(2 + length) };
+  };
+  // Calls f with a message, plus a payload if value is binary data.
+  const withValue = (message, value, f) => {
+    if (value instanceof Blob)
+      return value.arrayBuffer().then(buffer => f(message, buffer));
+    if (value instanceof ArrayBuffer || ArrayBuffer.isView(value))
+      return f(message, value);
+    return f({ ...message, value });
+  };
+
+  // Messages sent while disconnected wait for the next connection.
+  let connected = false;
+  let queued = [];
+  const queue = (message, payload) => queued.push([message, payload]);
+  let send = queue;
+  window.addEventListener('sendbroadcast', e => send({
+    name: 'broadcast',
+    value: e.detail,
+    channel: pageChannel,
+  }));
+
+  // The session token lasts as long as the tab, so the page keeps its ID
+  // when it reloads or reconnects.
+  const newSession = () => Array.from(crypto.getRandomValues(new Uint8Array(16)), b => b.toString(16).padStart(2, '0')).join('');
+  let session;
+  try {
+    session = sessionStorage.getItem('reserve-session');
+    if (!session) {
+      session = newSession();
+      sessionStorage.setItem('reserve-session', session);
+    }
+  } catch (e) {
+    session = newSession();
+  }
+  let clientId = null;
+  let metadata;
+  // Negative until the server says otherwise.
+  let maxMessageSize = -1;
+
+  // Requests waiting for a reply from the server, by ref.
+  let lastRef = 0;
+  const pending = new Map();
+  const request = (message, payload) => new Promise((resolve, reject) => {
+    const ref = ++lastRef;
+    pending.set(ref, { resolve, reject });
+    send({ ...message, ref }, payload);
+  });
+  const reply = (value, { ref }) => {
+    const req = pending.get(ref);
+    if (!req)
+      return;
+    pending.delete(ref);
+    req.resolve(value);
+  };
+  const fail = ({ error, message }, { ref }) => {
+    const req = pending.get(ref);
+    if (!req) {
+      console.warn(`reserve: ${message}`);
+      return;
+    }
+    pending.delete(ref);
+    const err = new Error(`reserve: ${message}`);
+    err.code = error;
+    req.reject(err);
+  };
+  // Pages that don't wait for a reply shouldn't see errors about it.
+  const quietly = promise => {
+    promise.catch(() => {});
+    return promise;
+  };
+  const broadcast = (message, options) => {
+    const { channel = pageChannel, excludeSelf, id } =
+      typeof options == 'string' ? { channel: options } : options || {};
+    return quietly(Promise.resolve(withValue({
+      name: 'broadcast',
+      channel,
+      excludeSelf,
+      id,
+    }, message, request)));
+  };
 
-  let queuedBroadcasts = [];
-  const queueBroadcast = message => queuedBroadcasts.push(message);
-  let broadcast = queueBroadcast;
-  window.addEventListener('sendbroadcast', e => broadcast(e.detail));
+  // The shared state, as of the last message from the server.
+  let stateVersion = 0;
+  let stateValues = {};
+  const applyState = ({ version, set = {}, deleted = [] }) => {
+    stateVersion = version;
+    Object.assign(stateValues, set);
+    for (const key of deleted)
+      delete stateValues[key];
+    window.dispatchEvent(new CustomEvent('statechange', {
+      detail: { version, set, deleted },
+    }));
+  };
+  const changeState = (name, key, value, { ifVersion } = {}) =>
+    quietly(request({ name, key, value, ifVersion }));
+  const clientEvent = name => info => {
+    window.dispatchEvent(new CustomEvent(name, { detail: info }));
+  };
 
   let clockSamples = [];
   let bestClockOffset = 0;
 
   const handleMessage = {
-    change: path => {
+    change: ({ kind, path, from, hash, affects }) => {
       const target = new URL(`/${path}`, location.href).href;
-      const cacheBustedTarget = target + cacheBustQuery();
+      const affected = (affects || []).map(p => new URL(p, location.href).href);
+      const cacheBustedTarget = target + cacheBustQuery(hash);
 
-      if (!window.dispatchEvent(new CustomEvent('sourcechange', {
+      const ev = new CustomEvent('sourcechange', {
         detail: target,
         cancelable: true,
-      })))
+      });
+      ev.kind = kind;
+      ev.hash = hash;
+      if (from)
+        ev.from = new URL(`/${from}`, location.href).href;
+      if (!window.dispatchEvent(ev))
+        return;
+
+      // Follow a stylesheet (or anything else linked) to its new name. If
+      // nothing pointed at the old name, like an editor's temporary file, treat
+      // it as a change to the new one.
+      if (kind == 'renamed' && ev.from && moveHook(ev.from, target)(cacheBustedTarget))
         return;
+      if (kind == 'removed' && window.__reserve_hot_modules && window.__reserve_hot_modules[target]) {
+        location.reload(true);
+        return;
+      }
 
       if (!(target in hooks)) {
         const ext = target.split('/').pop().split('.').pop();
@@ -106,6 +216,9 @@ window.__reserve_hooks_by_extension = {
       Promise.resolve()
         .then(() => hooks[target](cacheBustedTarget))
         .then(handled => handled || defaultHook(target)(cacheBustedTarget))
+        // Something that includes the file, like a stylesheet which @imports
+        // it, might be able to reload without reloading the whole page.
+        .then(handled => handled || affected.filter(f => defaultHook(f)(f + cacheBustQuery())).length > 0)
         .then(handled => handled || location.reload(true))
         .then(() => {
           for (const element of document.querySelectorAll('[data-reserve-notify-file="'+target+'"]'))
@@ -117,9 +230,39 @@ window.__reserve_hooks_by_extension = {
       ev.data = line;
       window.dispatchEvent(ev);
     },
-    broadcast: message => {
-      window.dispatchEvent(new CustomEvent('broadcast', { detail: message }))
+    broadcast: (message, { channel, from, id, history }) => {
+      const ev = new CustomEvent('broadcast', { detail: message });
+      ev.channel = channel;
+      ev.from = from;
+      ev.id = id;
+      ev.history = !!history;
+      window.dispatchEvent(ev);
+    },
+    welcome: ({ id, maxMessageSize: max }) => {
+      clientId = id;
+      maxMessageSize = max;
+    },
+    direct: (message, { from }) => {
+      const ev = new CustomEvent('direct', { detail: message });
+      ev.from = from;
+      window.dispatchEvent(ev);
+    },
+    clients: reply,
+    ack: reply,
+    error: fail,
+    state: change => {
+      // The snapshot sent on connecting may already include it.
+      if (change.version > stateVersion)
+        applyState(change);
+    },
+    'state-snapshot': ({ version, values }) => {
+      const deleted = Object.keys(stateValues).filter(key => !(key in values));
+      stateValues = {};
+      applyState({ version, set: values, deleted });
     },
+    clientjoin: clientEvent('clientjoin'),
+    clientleave: clientEvent('clientleave'),
+    clientupdate: clientEvent('clientupdate'),
     pong: message => {
       const { startTime, serverTime } = message;
       const now = Date.now();
@@ -135,8 +278,11 @@ window.__reserve_hooks_by_extension = {
   const connect = () => {
     let pingInterval;
     let deadTimeout;
+    // Requests written to this socket, as opposed to still queued.
+    const sent = new Set();
 
-    const ws = new WebSocket(`${location.protocol == 'https:' ? 'wss' : 'ws'}://${location.host}/.reserve/ws`);
+    const ws = new WebSocket(`${location.protocol == 'https:' ? 'wss' : 'ws'}://${location.host}/.reserve/ws?session=${session}&page=${encodeURIComponent(location.href)}`);
+    ws.binaryType = 'arraybuffer';
     ws.onopen = e => {
       pingInterval = setInterval(() => {
         ws.send(JSON.stringify({
@@ -145,15 +291,27 @@ window.__reserve_hooks_by_extension = {
         }));
       }, 1000 + Math.random() * 500);
 
-      broadcast = message => {
-        ws.send(JSON.stringify({
-          name: 'broadcast',
-          value: message,
-        }));
-      };
-      while (queuedBroadcasts.length)
-        broadcast(queuedBroadcasts.shift());
+      connected = true;
+      send = (message, payload) => {
+        const data = payload === undefined ?
+          JSON.stringify(message) : encodeFrame(message, payload);
+        // Strings are measured as UTF-8 only if they might be too big.
+        if (maxMessageSize >= 0 && data.length * 3 > maxMessageSize &&
+            (typeof data == 'string' ? new TextEncoder().encode(data) : data).length > maxMessageSize) {
+          fail({ error: 'too-big', message: `messages can be at most ${maxMessageSize} bytes` }, message);
+          return;
+        }
+        ws.send(data);
+        if (message.ref)
+          sent.add(message.ref);
       };
+      if (metadata !== undefined)
+        send({ name: 'metadata', value: metadata });
+      for (const channel of channels)
+        send({ name: 'join', value: channel });
+      while (queued.length)
+        send(...queued.shift());
+    };
 
     const resetDead = () => {
       if (deadTimeout)
@@ -167,21 +325,97 @@ window.__reserve_hooks_by_extension = {
 
     ws.onmessage = e => {
       resetDead();
-      const { name, value } = JSON.parse(e.data);
-      handleMessage[name](value);
+      const message = typeof e.data == 'string' ? JSON.parse(e.data) : decodeFrame(e.data);
+      handleMessage[message.name](message.value, message);
     };
     ws.onclose = e => {
       clearInterval(pingInterval);
       clearTimeout(deadTimeout);
       setTimeout(connect, 1000);
-      broadcast = queueBroadcast;
+      connected = false;
+      send = queue;
+      // Replies to anything already sent won't come. Anything still queued
+      // goes out on the next connection.
+      for (const ref of sent) {
+        const req = pending.get(ref);
+        if (!req)
+          continue;
+        pending.delete(ref);
+        req.reject(new Error('reserve: disconnected'));
+      }
+      sent.clear();
     };
   };
   connect();
 
   window.reserve = {
-    broadcast(message) {
-      broadcast(message);
+    // message can be anything JSON can represent, or binary data (an
+    // ArrayBuffer, typed array or Blob, which arrives as an ArrayBuffer).
+    // options can be a channel name, or { channel, excludeSelf, id }.
+    // Resolves to { id, recipients } once the server has passed the message
+    // on.
+    broadcast(message, options) {
+      return broadcast(message, options);
+    },
+    join(channel) {
+      if (channels.has(channel))
+        return;
+      channels.add(channel);
+      if (connected)
+        send({ name: 'join', value: channel });
+    },
+    leave(channel) {
+      if (!channels.delete(channel))
+        return;
+      if (connected)
+        send({ name: 'leave', value: channel });
+    },
+    get channels() {
+      return [...channels];
+    },
+    // null until the page first connects.
+    get id() {
+      return clientId;
+    },
+    send(id, message) {
+      withValue({ name: 'send', to: id }, message, send);
+    },
+    // Resolves to a list of connected pages, like
+    // [{ id, page, userAgent, metadata }].
+    clients() {
+      return request({ name: 'clients' });
+    },
+    // Values shared by every page. Changes resolve to { version } once
+    // they've been made, or fail if options.ifVersion is given and doesn't
+    // match the current version.
+    state: {
+      get version() {
+        return stateVersion;
+      },
+      get values() {
+        return { ...stateValues };
+      },
+      get(key) {
+        return stateValues[key];
+      },
+      set(key, value, options) {
+        return changeState('state-set', key, value, options);
+      },
+      // Applies a JSON merge patch to one key, or (without a key) to the
+      // whole state.
+      patch(key, patch, options) {
+        if (typeof key != 'string')
+          return changeState('state-patch', undefined, key, patch);
+        return changeState('state-patch', key, patch, options);
+      },
+      delete(key, options) {
+        return changeState('state-delete', key, undefined, options);
+      },
+    },
+    setMetadata(value) {
+      metadata = value;
+      if (connected)
+        send({ name: 'metadata', value });
     },
     now() {
       return Date.now() - bestClockOffset;
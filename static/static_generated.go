@@ -18,8 +18,8 @@ package static
 
 import "time"
 
-var ModTime = time.Unix(0, 1744005044646115000)
+var ModTime = time.Unix(0, 1792267567674135881)
 
 const FilterHtml = "<script src=\"/.reserve/reserve.js\"></script><script src=\"/.reserve/reserve_modules.js\"></script>\n"
-const ReserveJs = "// Copyright 2019 The Reserve Authors\n//\n// Licensed under the Apache License, Version 2.0 (the \"License\");\n// you may not use this file except in compliance with the License.\n// You may obtain a copy of the License at\n//\n//     https://www.apache.org/licenses/LICENSE-2.0\n//\n// Unless required by applicable law or agreed to in writing, software\n// distributed under the License is distributed on an \"AS IS\" BASIS,\n// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.\n// See the License for the specific language governing permissions and\n// limitations under the License.\n\n'use strict';\n\nwindow.__reserve_hooks_by_extension = {\n  html: f => new_f => {\n    // The current page, minus any query string or hash.\n    let curpage = new URL(location.pathname, location.href).href;\n    let target = f.replace(/index\\.html$/, '');\n    if (curpage == target)\n      location.reload();\n    return true;\n  },\n};\n\n(() => {\n  const ignorePats = [];\n  const shouldIgnore = path => {\n    for (const pat of ignorePats) {\n      if (pat[0] == '/' && path.startsWith(pat))\n        return true;\n    }\n    return false;\n  };\n  const reloadIgnoreFile = () => {\n    fetch('/.reserveignore')\n      .then(r => r.text())\n      .then(text => {\n        ignorePats.length = 0;\n        for (const pat of text.split('\\n')) {\n          if (pat)\n            ignorePats.push(pat);\n        }\n      });\n  };\n  reloadIgnoreFile();\n\n  window.addEventListener('sourcechange', e => {\n    const changedPath = new URL(e.detail, location.href).pathname;\n    if (changedPath == '/.reserveignore') {\n      reloadIgnoreFile();\n      e.preventDefault();\n      return;\n    } else if (shouldIgnore(changedPath)) {\n      e.preventDefault();\n    }\n  });\n\n  const defaultHook = f => new_f => {\n    let handled = false;\n    for (let el of document.querySelectorAll('link')) {\n      if (el.rel == \"x-reserve-ignore\") {\n        const re = new RegExp(el.dataset.expr);\n        if (re.test(f))\n          handled = true;\n        continue;\n      }\n      if (el.href != f && el.dataset.ohref != f)\n        continue;\n      if (!el.dataset.ohref)\n        el.dataset.ohref = el.href;\n      el.href = new_f;\n      handled = true;\n    }\n    return handled;\n  };\n  const hooks = {};\n  const cacheBustQuery = () => `?cache_bust=${+new Date}`;\n\n  let queuedBroadcasts = [];\n  const queueBroadcast = message => queuedBroadcasts.push(message);\n  let broadcast = queueBroadcast;\n  window.addEventListener('sendbroadcast', e => broadcast(e.detail));\n\n  let clockSamples = [];\n  let bestClockOffset = 0;\n\n  const handleMessage = {\n    change: path => {\n      const target = new URL(`/${path}`, location.href).href;\n      const cacheBustedTarget = target + cacheBustQuery();\n\n      if (!window.dispatchEvent(new CustomEvent('sourcechange', {\n        detail: target,\n        cancelable: true,\n      })))\n        return;\n\n      if (!(target in hooks)) {\n        const ext = target.split('/').pop().split('.').pop();\n        const genHook = window.__reserve_hooks_by_extension[ext];\n        hooks[target] = genHook ? genHook(target) : () => Promise.resolve();\n      }\n      Promise.resolve()\n        .then(() => hooks[target](cacheBustedTarget))\n        .then(handled => handled || defaultHook(target)(cacheBustedTarget))\n        .then(handled => handled || location.reload(true))\n        .then(() => {\n          for (const element of document.querySelectorAll('[data-reserve-notify-file=\"'+target+'\"]'))\n            element.dispatchEvent(new CustomEvent('sourcechange'));\n        });\n    },\n    stdin: line => {\n      const ev = new CustomEvent('stdin');\n      ev.data = line;\n      window.dispatchEvent(ev);\n    },\n    broadcast: message => {\n      window.dispatchEvent(new CustomEvent('broadcast', { detail: message }))\n    },\n    pong: message => {\n      const { startTime, serverTime } = message;\n      const now = Date.now();\n      const rtt = now - startTime;\n      const proposedOffset = now - serverTime;\n      clockSamples.push(proposedOffset - rtt / 2);\n      while (clockSamples.length > 30)\n        clockSamples.shift();\n      bestClockOffset = clockSamples.reduce((best, x) => (Math.abs(best) < Math.abs(x)) ? best : x);\n    },\n  };\n\n  const connect = () => {\n    let pingInterval;\n    let deadTimeout;\n\n    const ws = new WebSocket(`${location.protocol == 'https:' ? 'wss' : 'ws'}://${location.host}/.reserve/ws`);\n    ws.onopen = e => {\n      pingInterval = setInterval(() => {\n        ws.send(JSON.stringify({\n          name: 'ping',\n          value: Date.now(),\n        }));\n      }, 1000 + Math.random() * 500);\n\n      broadcast = message => {\n        ws.send(JSON.stringify({\n          name: 'broadcast',\n          value: message,\n        }));\n      };\n      while (queuedBroadcasts.length)\n        broadcast(queuedBroadcasts.shift());\n      };\n\n    const resetDead = () => {\n      if (deadTimeout)\n        clearTimeout(deadTimeout);\n      deadTimeout = setTimeout(() => {\n        ws.close();\n        ws.onclose();\n      }, 5000);\n    };\n    resetDead();\n\n    ws.onmessage = e => {\n      resetDead();\n      const { name, value } = JSON.parse(e.data);\n      handleMessage[name](value);\n    };\n    ws.onclose = e => {\n      clearInterval(pingInterval);\n      clearTimeout(deadTimeout);\n      setTimeout(connect, 1000);\n      broadcast = queueBroadcast;\n    };\n  };\n  connect();\n\n  window.reserve = {\n    broadcast(message) {\n      broadcast(message);\n    },\n    now() {\n      return Date.now() - bestClockOffset;\n    },\n  };\n})();\n"
+const ReserveJs = "// Copyright 2019 The Reserve Authors\n//\n// Licensed under the Apache License, Version 2.0 (the \"License\");\n// you may not use this file except in compliance with the License.\n// You may obtain a copy of the License at\n//\n//     https://www.apache.org/licenses/LICENSE-2.0\n//\n// Unless required by applicable law or agreed to in writing, software\n// distributed under the License is distributed on an \"AS IS\" BASIS,\n// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.\n// See the License for the specific language governing permissions and\n// limitations under the License.\n\n'use strict';\n\nwindow.__reserve_hooks_by_extension = {\n  html: f => new_f => {\n    // The current page, minus any query string or hash.\n    let curpage = new URL(location.pathname, location.href).href;\n    let target = f.replace(/index\\.html$/, '');\n    if (curpage == target)\n      location.reload();\n    return true;\n  },\n};\n\n(() => {\n  const defaultHook = f => new_f => {\n    let handled = false;\n    for (let el of document.querySelectorAll('link')) {\n      if (el.rel == \"x-reserve-ignore\") {\n        const re = new RegExp(el.dataset.expr);\n        if (re.test(f))\n          handled = true;\n        continue;\n      }\n      if (el.href != f && el.dataset.ohref != f)\n        continue;\n      if (!el.dataset.ohref)\n        el.dataset.ohref = el.href;\n      el.href = new_f;\n      handled = true;\n    }\n    return handled;\n  };\n  const moveHook = (from, to) => new_f => {\n    let handled = false;\n    for (let el of document.querySelectorAll('link')) {\n      if (el.href != from && el.dataset.ohref != from)\n        continue;\n      el.dataset.ohref = to;\n      el.href = new_f;\n      handled = true;\n    }\n    return handled;\n  };\n  const hooks = {};\n  const cacheBustQuery = hash => `?cache_bust=${hash || +new Date}`;\n\n  // Broadcasts go to the page's own path unless they name another channel.\n  const pageChannel = location.pathname;\n  const channels = new Set([pageChannel]);\n\n  // Binary messages are sent as a header (a message without a value, as\n  // JSON), preceded by its length as two bytes, and then the payload.\n  const encodeFrame = (message, payload) => {\n    const header = new TextEncoder().encode(JSON.stringify(message));\n    const bytes = ArrayBuffer.isView(payload) ?\n      new Uint8Array(payload.buffer, payload.byteOffset, payload.byteLength) :\n      new Uint8Array(payload);\n    const frame = new Uint8Array(2 + header.length + bytes.length);\n    new DataView(frame.buffer).setUint16(0, header.length);\n    frame.set(header, 2);\n    frame.set(bytes, 2 + header.length);\n    return frame;\n  };\n  const decodeFrame = buffer => {\n    const length = new DataView(buffer).getUint16(0);\n    const header = JSON.parse(new TextDecoder().decode(new Uint8Array(buffer, 2, length)));\n    return { ...header, value: buffer.slice(2 + length) };\n  };\n  // Calls f with a message, plus a payload if value is binary data.\n  const withValue = (message, value, f) => {\n    if (value instanceof Blob)\n      return value.arrayBuffer().then(buffer => f(message, buffer));\n    if (value instanceof ArrayBuffer || ArrayBuffer.isView(value))\n      return f(message, value);\n    return f({ ...message, value });\n  };\n\n  // Messages sent while disconnected wait for the next connection.\n  let connected = false;\n  let queued = [];\n  const queue = (message, payload) => queued.push([message, payload]);\n  let send = queue;\n  window.addEventListener('sendbroadcast', e => send({\n    name: 'broadcast',\n    value: e.detail,\n    channel: pageChannel,\n  }));\n\n  // The session token lasts as long as the tab, so the page keeps its ID\n  // when it reloads or reconnects.\n  const newSession = () => Array.from(crypto.getRandomValues(new Uint8Array(16)), b => b.toString(16).padStart(2, '0')).join('');\n  let session;\n  try {\n    session = sessionStorage.getItem('reserve-session');\n    if (!session) {\n      session = newSession();\n      sessionStorage.setItem('reserve-session', session);\n    }\n  } catch (e) {\n    session = newSession();\n  }\n  let clientId = null;\n  let metadata;\n  // Negative until the server says otherwise.\n  let maxMessageSize = -1;\n\n  // Requests waiting for a reply from the server, by ref.\n  let lastRef = 0;\n  const pending = new Map();\n  const request = (message, payload) => new Promise((resolve, reject) => {\n    const ref = ++lastRef;\n    pending.set(ref, { resolve, reject });\n    send({ ...message, ref }, payload);\n  });\n  const reply = (value, { ref }) => {\n    const req = pending.get(ref);\n    if (!req)\n      return;\n    pending.delete(ref);\n    req.resolve(value);\n  };\n  const fail = ({ error, message }, { ref }) => {\n    const req = pending.get(ref);\n    if (!req) {\n      console.warn(`reserve: ${message}`);\n      return;\n    }\n    pending.delete(ref);\n    const err = new Error(`reserve: ${message}`);\n    err.code = error;\n    req.reject(err);\n  };\n  // Pages that don't wait for a reply shouldn't see errors about it.\n  const quietly = promise => {\n    promise.catch(() => {});\n    return promise;\n  };\n  const broadcast = (message, options) => {\n    const { channel = pageChannel, excludeSelf, id } =\n      typeof options == 'string' ? { channel: options } : options || {};\n    return quietly(Promise.resolve(withValue({\n      name: 'broadcast',\n      channel,\n      excludeSelf,\n      id,\n    }, message, request)));\n  };\n\n  // The shared state, as of the last message from the server.\n  let stateVersion = 0;\n  let stateValues = {};\n  const applyState = ({ version, set = {}, deleted = [] }) => {\n    stateVersion = version;\n    Object.assign(stateValues, set);\n    for (const key of deleted)\n      delete stateValues[key];\n    window.dispatchEvent(new CustomEvent('statechange', {\n      detail: { version, set, deleted },\n    }));\n  };\n  const changeState = (name, key, value, { ifVersion } = {}) =>\n    quietly(request({ name, key, value, ifVersion }));\n  const clientEvent = name => info => {\n    window.dispatchEvent(new CustomEvent(name, { detail: info }));\n  };\n\n  let clockSamples = [];\n  let bestClockOffset = 0;\n\n  const handleMessage = {\n    change: ({ kind, path, from, hash, affects }) => {\n      const target = new URL(`/${path}`, location.href).href;\n      const affected = (affects || []).map(p => new URL(p, location.href).href);\n      const cacheBustedTarget = target + cacheBustQuery(hash);\n\n      const ev = new CustomEvent('sourcechange', {\n        detail: target,\n        cancelable: true,\n      });\n      ev.kind = kind;\n      ev.hash = hash;\n      if (from)\n        ev.from = new URL(`/${from}`, location.href).href;\n      if (!window.dispatchEvent(ev))\n        return;\n\n      // Follow a stylesheet (or anything else linked) to its new name. If\n      // nothing pointed at the old name, like an editor's temporary file, treat\n      // it as a change to the new one.\n      if (kind == 'renamed' && ev.from && moveHook(ev.from, target)(cacheBustedTarget))\n        return;\n      if (kind == 'removed' && window.__reserve_hot_modules && window.__reserve_hot_modules[target]) {\n        location.reload(true);\n        return;\n      }\n\n      if (!(target in hooks)) {\n        const ext = target.split('/').pop().split('.').pop();\n        const genHook = window.__reserve_hooks_by_extension[ext];\n        hooks[target] = genHook ? genHook(target) : () => Promise.resolve();\n      }\n      Promise.resolve()\n        .then(() => hooks[target](cacheBustedTarget))\n        .then(handled => handled || defaultHook(target)(cacheBustedTarget))\n        // Something that includes the file, like a stylesheet which @imports\n        // it, might be able to reload without reloading the whole page.\n        .then(handled => handled || affected.filter(f => defaultHook(f)(f + cacheBustQuery())).length > 0)\n        .then(handled => handled || location.reload(true))\n        .then(() => {\n          for (const element of document.querySelectorAll('[data-reserve-notify-file=\"'+target+'\"]'))\n            element.dispatchEvent(new CustomEvent('sourcechange'));\n        });\n    },\n    stdin: line => {\n      const ev = new CustomEvent('stdin');\n      ev.data = line;\n      window.dispatchEvent(ev);\n    },\n    broadcast: (message, { channel, from, id, history }) => {\n      const ev = new CustomEvent('broadcast', { detail: message });\n      ev.channel = channel;\n      ev.from = from;\n      ev.id = id;\n      ev.history = !!history;\n      window.dispatchEvent(ev);\n    },\n    welcome: ({ id, maxMessageSize: max }) => {\n      clientId = id;\n      maxMessageSize = max;\n    },\n    direct: (message, { from }) => {\n      const ev = new CustomEvent('direct', { detail: message });\n      ev.from = from;\n      window.dispatchEvent(ev);\n    },\n    clients: reply,\n    ack: reply,\n    error: fail,\n    state: change => {\n      // The snapshot sent on connecting may already include it.\n      if (change.version > stateVersion)\n        applyState(change);\n    },\n    'state-snapshot': ({ version, values }) => {\n      const deleted = Object.keys(stateValues).filter(key => !(key in values));\n      stateValues = {};\n      applyState({ version, set: values, deleted });\n    },\n    clientjoin: clientEvent('clientjoin'),\n    clientleave: clientEvent('clientleave'),\n    clientupdate: clientEvent('clientupdate'),\n    pong: message => {\n      const { startTime, serverTime } = message;\n      const now = Date.now();\n      const rtt = now - startTime;\n      const proposedOffset = now - serverTime;\n      clockSamples.push(proposedOffset - rtt / 2);\n      while (clockSamples.length > 30)\n        clockSamples.shift();\n      bestClockOffset = clockSamples.reduce((best, x) => (Math.abs(best) < Math.abs(x)) ? best : x);\n    },\n  };\n\n  const connect = () => {\n    let pingInterval;\n    let deadTimeout;\n    // Requests written to this socket, as opposed to still queued.\n    const sent = new Set();\n\n    const ws = new WebSocket(`${location.protocol == 'https:' ? 'wss' : 'ws'}://${location.host}/.reserve/ws?session=${session}&page=${encodeURIComponent(location.href)}`);\n    ws.binaryType = 'arraybuffer';\n    ws.onopen = e => {\n      pingInterval = setInterval(() => {\n        ws.send(JSON.stringify({\n          name: 'ping',\n          value: Date.now(),\n        }));\n      }, 1000 + Math.random() * 500);\n\n      connected = true;\n      send = (message, payload) => {\n        const data = payload === undefined ?\n          JSON.stringify(message) : encodeFrame(message, payload);\n        // Strings are measured as UTF-8 only if they might be too big.\n        if (maxMessageSize >= 0 && data.length * 3 > maxMessageSize &&\n            (typeof data == 'string' ? new TextEncoder().encode(data) : data).length > maxMessageSize) {\n          fail({ error: 'too-big', message: `messages can be at most ${maxMessageSize} bytes` }, message);\n          return;\n        }\n        ws.send(data);\n        if (message.ref)\n          sent.add(message.ref);\n      };\n      if (metadata !== undefined)\n        send({ name: 'metadata', value: metadata });\n      for (const channel of channels)\n        send({ name: 'join', value: channel });\n      while (queued.length)\n        send(...queued.shift());\n    };\n\n    const resetDead = () => {\n      if (deadTimeout)\n        clearTimeout(deadTimeout);\n      deadTimeout = setTimeout(() => {\n        ws.close();\n        ws.onclose();\n      }, 5000);\n    };\n    resetDead();\n\n    ws.onmessage = e => {\n      resetDead();\n      const message = typeof e.data == 'string' ? JSON.parse(e.data) : decodeFrame(e.data);\n      handleMessage[message.name](message.value, message);\n    };\n    ws.onclose = e => {\n      clearInterval(pingInterval);\n      clearTimeout(deadTimeout);\n      setTimeout(connect, 1000);\n      connected = false;\n      send = queue;\n      // Replies to anything already sent won't come. Anything still queued\n      // goes out on the next connection.\n      for (const ref of sent) {\n        const req = pending.get(ref);\n        if (!req)\n          continue;\n        pending.delete(ref);\n        req.reject(new Error('reserve: disconnected'));\n      }\n      sent.clear();\n    };\n  };\n  connect();\n\n  window.reserve = {\n    // message can be anything JSON can represent, or binary data (an\n    // ArrayBuffer, typed array or Blob, which arrives as an ArrayBuffer).\n    // options can be a channel name, or { channel, excludeSelf, id }.\n    // Resolves to { id, recipients } once the server has passed the message\n    // on.\n    broadcast(message, options) {\n      return broadcast(message, options);\n    },\n    join(channel) {\n      if (channels.has(channel))\n        return;\n      channels.add(channel);\n      if (connected)\n        send({ name: 'join', value: channel });\n    },\n    leave(channel) {\n      if (!channels.delete(channel))\n        return;\n      if (connected)\n        send({ name: 'leave', value: channel });\n    },\n    get channels() {\n      return [...channels];\n    },\n    // null until the page first connects.\n    get id() {\n      return clientId;\n    },\n    send(id, message) {\n      withValue({ name: 'send', to: id }, message, send);\n    },\n    // Resolves to a list of connected pages, like\n    // [{ id, page, userAgent, metadata }].\n    clients() {\n      return request({ name: 'clients' });\n    },\n    // Values shared by every page. Changes resolve to { version } once\n    // they've been made, or fail if options.ifVersion is given and doesn't\n    // match the current version.\n    state: {\n      get version() {\n        return stateVersion;\n      },\n      get values() {\n        return { ...stateValues };\n      },\n      get(key) {\n        return stateValues[key];\n      },\n      set(key, value, options) {\n        return changeState('state-set', key, value, options);\n      },\n      // Applies a JSON merge patch to one key, or (without a key) to the\n      // whole state.\n      patch(key, patch, options) {\n        if (typeof key != 'string')\n          return changeState('state-patch', undefined, key, patch);\n        return changeState('state-patch', key, patch, options);\n      },\n      delete(key, options) {\n        return changeState('state-delete', key, undefined, options);\n      },\n    },\n    setMetadata(value) {\n      metadata = value;\n      if (connected)\n        send({ name: 'metadata', value });\n    },\n    now() {\n      return Date.now() - bestClockOffset;\n    },\n  };\n})();\n"
 const ReserveModulesJs = "// Copyright 2019 The Reserve Authors\n//\n// Licensed under the Apache License, Version 2.0 (the \"License\");\n// you may not use this file except in compliance with the License.\n// You may obtain a copy of the License at\n//\n//     https://www.apache.org/licenses/LICENSE-2.0\n//\n// Unless required by applicable law or agreed to in writing, software\n// distributed under the License is distributed on an \"AS IS\" BASIS,\n// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.\n// See the License for the specific language governing permissions and\n// limitations under the License.\n\nwindow.__reserve_hooks_by_extension.js = f => {\n  let last_f = f;\n  return f_new => {\n    if (!window.__reserve_hot_modules || !window.__reserve_hot_modules[f])\n      return false;\n    const next_f = `${f_new}&raw`;\n    return Promise.all([\n        import(f),\n        import(last_f),\n        import(next_f),\n      ])\n      .then(mods => {\n        last_f = next_f;\n        const [origm, oldm, newm] = mods;\n        if (!origm.__reserve_setters)\n          location.reload(true);\n        if (oldm.default.__on_module_reloaded)\n          newm.default.__on_module_reloaded = oldm.default.__on_module_reloaded;\n        if (oldm.default.__file)\n          newm.default.__file = oldm.default.__file;\n        if (!Object.prototype.hasOwnProperty.call(oldm.default.prototype, 'adopt'))\n          oldm.default.prototype.adopt = function(){};\n        if (!Object.prototype.hasOwnProperty.call(newm.default.prototype, 'adopt'))\n          newm.default.prototype.adopt = function(){};\n        for (const k in newm) {\n          const oldproto = oldm[k].prototype;\n          const newproto = newm[k].prototype;\n          if (oldproto) {\n            for (const protok of Object.getOwnPropertyNames(oldproto)) {\n              if (protok === 'constructor')\n                continue;\n              Object.defineProperty(oldproto, protok, { value: function (...args) {\n                if (Object.getPrototypeOf(this) != oldproto)\n                  return false;\n                Object.setPrototypeOf(this, newproto);\n                if (this.adopt && protok != 'adopt')\n                  this.adopt(oldproto);\n                return this[protok](...args);\n              } });\n            }\n          }\n          const setter = origm.__reserve_setters[k];\n          if (!setter)\n            location.reload(true);\n          setter(newm[k]);\n\n          if (newm.default.__on_module_reloaded) {\n            for (const f of newm.default.__on_module_reloaded)\n              f();\n          }\n        }\n        return true;\n      });\n  };\n};\n"
@@ -0,0 +1,193 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reserve
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// history keeps the last few broadcasts to each channel, to replay to pages
+// that join it later.
+type history struct {
+	lock     sync.Mutex
+	size     int
+	channels map[string][]Message
+}
+
+func (h *history) add(msg Message) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.channels == nil {
+		h.channels = make(map[string][]Message)
+	}
+	msgs := append(h.channels[msg.Channel], msg)
+	if len(msgs) > h.size {
+		msgs = append([]Message{}, msgs[len(msgs)-h.size:]...)
+	}
+	h.channels[msg.Channel] = msgs
+}
+
+func (h *history) get(channel string) []Message {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]Message{}, h.channels[channel]...)
+}
+
+func (h *history) all() map[string][]Message {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	channels := make(map[string][]Message, len(h.channels))
+	for channel, msgs := range h.channels {
+		channels[channel] = msgs
+	}
+	return channels
+}
+
+func (h *history) restore(channels map[string][]Message) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.channels = make(map[string][]Message, len(channels))
+	for channel, msgs := range channels {
+		if len(msgs) > h.size {
+			msgs = msgs[len(msgs)-h.size:]
+		}
+		if len(msgs) > 0 {
+			h.channels[channel] = msgs
+		}
+	}
+}
+
+// The store is written at most this often.
+const storeSaveInterval = time.Second
+
+// storeFile is what's saved to StorePath.
+type storeFile struct {
+	State   stateSnapshot        `json:"state"`
+	History map[string][]Message `json:"history,omitempty"`
+}
+
+// A saver writes the store to disk in the background after it changes.
+type saver struct {
+	dirty   chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// storeFilePaths returns the absolute paths, with symlinks resolved, of the
+// store and the temporary file it's written to first.
+func storeFilePaths(storePath string) map[string]bool {
+	absPath, err := filepath.Abs(storePath)
+	if err != nil {
+		return nil
+	}
+	dir := filepath.Dir(absPath)
+	if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = realDir
+	}
+	p := filepath.Join(dir, filepath.Base(absPath))
+	return map[string]bool{p: true, p + ".tmp": true}
+}
+
+func (s *Server) loadStore() error {
+	data, err := os.ReadFile(s.StorePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	s.state.restore(file.State)
+	s.history.restore(file.History)
+	return nil
+}
+
+func (s *Server) saveStore() error {
+	data, err := json.Marshal(storeFile{s.state.snapshot(), s.history.all()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.StorePath), 0755); err != nil {
+		return err
+	}
+	// Write the whole file and then move it into place, so that it's never
+	// left half-written.
+	tmpPath := s.StorePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.StorePath)
+}
+
+func (s *Server) startSaving() {
+	s.saver = &saver{
+		dirty:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func(sv *saver) {
+		defer close(sv.stopped)
+		save := func() {
+			if err := s.saveStore(); err != nil {
+				log.Printf("Couldn't save %s: %v", s.StorePath, err)
+			}
+		}
+		for {
+			select {
+			case <-sv.dirty:
+				save()
+				select {
+				case <-time.After(storeSaveInterval):
+				case <-sv.stop:
+				}
+			case <-sv.stop:
+				save()
+				return
+			}
+		}
+	}(s.saver)
+}
+
+// stopSaving saves the store one last time.
+func (s *Server) stopSaving() {
+	if s.saver == nil {
+		return
+	}
+	select {
+	case <-s.saver.stop:
+		// Already stopped.
+	default:
+		close(s.saver.stop)
+	}
+	<-s.saver.stopped
+}
+
+// storeChanged says that the store needs to be saved, if there is one.
+func (s *Server) storeChanged() {
+	if s.saver == nil {
+		return
+	}
+	select {
+	case s.saver.dirty <- struct{}{}:
+	default:
+	}
+}
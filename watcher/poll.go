@@ -0,0 +1,206 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+// A source feeds raw events for a directory tree to a Watcher, which does
+// the work of coalescing and filtering them.
+type source interface {
+	stop()
+}
+
+type notifySource struct {
+	events chan<- notify.EventInfo
+}
+
+func startNotify(dir string, events chan<- notify.EventInfo) (source, error) {
+	if err := notify.Watch(filepath.Join(dir, "..."), events, notify.All); err != nil {
+		return nil, err
+	}
+	return notifySource{events}, nil
+}
+
+func (s notifySource) stop() {
+	notify.Stop(s.events)
+}
+
+// pollEvent fakes the events notify would have delivered, so the Watcher
+// doesn't need to know where they came from.
+type pollEvent struct {
+	event notify.Event
+	path  string
+}
+
+func (e pollEvent) Event() notify.Event { return e.event }
+func (e pollEvent) Path() string        { return e.path }
+func (e pollEvent) Sys() interface{}    { return nil }
+
+type fileState struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// pollSource finds changes by scanning the whole tree every so often, for
+// filesystems (network mounts, some container bind mounts) which don't
+// deliver notifications.
+type pollSource struct {
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// scan records everything in dir but what exclude skips. Directories that
+// ignore matches are recorded, but not looked inside.
+func scan(dir string, exclude func(string) bool, ignore func(string, bool) bool) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Something was removed mid-scan, or isn't readable. Skip it.
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if p == dir {
+			return nil
+		}
+		relpath, err := filepath.Rel(dir, p)
+		if err != nil {
+			return nil
+		}
+		relpath = filepath.ToSlash(relpath)
+		if exclude(relpath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[p] = fileState{
+			isDir:   d.IsDir(),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+		if d.IsDir() && ignore != nil && ignore(relpath, true) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return files, err
+}
+
+func startPolling(dir string, interval time.Duration, exclude func(string) bool, ignore func(string, bool) bool, events chan<- notify.EventInfo) (source, error) {
+	prev, err := scan(dir, exclude, ignore)
+	if err != nil {
+		return nil, err
+	}
+	s := &pollSource{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		send := func(event notify.Event, p string) bool {
+			select {
+			case events <- pollEvent{event, p}:
+				return true
+			case <-s.done:
+				return false
+			}
+		}
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.done:
+				return
+			}
+			cur, err := scan(dir, exclude, ignore)
+			if err != nil {
+				continue
+			}
+			var removed []string
+			for p := range prev {
+				if _, ok := cur[p]; !ok {
+					removed = append(removed, p)
+				}
+			}
+			// Renaming a file keeps its size and modification time, so a file
+			// which disappeared and one which appeared with the same ones are
+			// reported as a rename, like notify would.
+			movedFrom := make(map[[2]int64][]string)
+			for _, p := range removed {
+				if state := prev[p]; !state.isDir {
+					key := [2]int64{state.size, state.modTime.UnixNano()}
+					movedFrom[key] = append(movedFrom[key], p)
+				}
+			}
+			renamed := make(map[string]bool)
+			for p, state := range cur {
+				old, ok := prev[p]
+				var event notify.Event
+				switch {
+				case !ok:
+					event = notify.Create
+					from := movedFrom[[2]int64{state.size, state.modTime.UnixNano()}]
+					if !state.isDir && len(from) == 1 && !renamed[from[0]] {
+						event |= notify.Rename
+						renamed[from[0]] = true
+					}
+				case state.isDir != old.isDir:
+					event = notify.Create
+				case state.isDir:
+					// A directory's modification time changes when anything
+					// in it does, but notify wouldn't report that.
+					continue
+				case state.size != old.size || !state.modTime.Equal(old.modTime):
+					event = notify.Write
+				default:
+					continue
+				}
+				if !send(event, p) {
+					return
+				}
+			}
+			for _, p := range removed {
+				event := notify.Remove
+				if renamed[p] {
+					event |= notify.Rename
+				}
+				if !send(event, p) {
+					return
+				}
+			}
+			prev = cur
+		}
+	}()
+	return s, nil
+}
+
+func (s *pollSource) stop() {
+	close(s.done)
+	<-s.stopped
+}
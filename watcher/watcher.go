@@ -15,94 +15,430 @@
 package watcher
 
 import (
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rjeczalik/notify"
 )
 
 func hasHiddenComponent(p string) bool {
-	rest := p
-	for {
-		if strings.HasPrefix(filepath.Base(rest), ".") {
+	for _, component := range strings.Split(p, "/") {
+		if strings.HasPrefix(component, ".") {
 			return true
 		}
-		next := filepath.Dir(rest)
-		if next == rest {
-			break
-		}
-		rest = next
 	}
 	return false
 }
 
+// DefaultExclude skips hidden files (except .reserveignore) and anything in a
+// hidden directory, plus Vim backup files.
+func DefaultExclude(p string) bool {
+	return (path.Base(p) != ".reserveignore" && hasHiddenComponent(p)) ||
+		// Vim backup files. This check can be tightened up if it's an issue
+		// for anyone.
+		strings.HasSuffix(p, "~")
+}
+
+const (
+	// 3ms felt right, but might not be.
+	DefaultQuiet        = 3 * time.Millisecond
+	DefaultMaxWait      = 250 * time.Millisecond
+	DefaultPollInterval = 500 * time.Millisecond
+)
+
+// Options configures a Watcher. The zero value uses the defaults.
+type Options struct {
+	// How long to wait after an event for more events before reporting
+	// changes. Defaults to DefaultQuiet.
+	Quiet time.Duration
+	// The longest a steady stream of events can hold off reporting changes.
+	// Defaults to DefaultMaxWait.
+	MaxWait time.Duration
+
+	// If set, only paths for which Include returns true are reported.
+	Include func(path string) bool
+	// Paths for which Exclude returns true aren't reported. Defaults to
+	// DefaultExclude. Both are passed slash-separated paths relative to the
+	// watched directory.
+	Exclude func(path string) bool
+	// If set, the watcher doesn't read files for which Ignore returns true
+	// when it starts, or look inside directories it matches then (or at all,
+	// when polling). It's for paths the caller drops anyway, like a big
+	// node_modules.
+	Ignore func(path string, isDir bool) bool
+
+	// Scan the directory for changes every PollInterval instead of asking the
+	// OS for notifications. The watcher falls back to polling on its own if
+	// notifications aren't available, but some filesystems (like network
+	// mounts) accept a watch and then never deliver anything.
+	Poll bool
+	// Defaults to DefaultPollInterval.
+	PollInterval time.Duration
+}
+
+// Kind describes what happened to a path.
+type Kind string
+
+const (
+	Created  Kind = "created"
+	Modified Kind = "modified"
+	Removed  Kind = "removed"
+	Renamed  Kind = "renamed"
+)
+
+// A Change describes something that happened to a file or directory in the
+// watched tree. Paths are relative to the watched directory.
+type Change struct {
+	Kind Kind   `json:"kind"`
+	Path string `json:"path"`
+	// For renames, the path the file was moved from.
+	From string `json:"from,omitempty"`
+	// A hash of the file's new contents, if it's a regular file that still
+	// exists.
+	Hash string `json:"hash,omitempty"`
+	// Whether the path is a directory, or was one before it was removed.
+	IsDir bool `json:"isDir,omitempty"`
+}
+
 type Watcher struct {
-	Changes chan string
+	Changes chan Change
+
+	dir       string
+	opts      Options
+	events    chan notify.EventInfo
+	source    source
+	polling   bool
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	// Hashes of files that were already there, from seed, and closed once
+	// they've all been handed to run.
+	hashed chan hashedFile
+	seeded chan struct{}
+
+	// Everything known to be in the tree, and the last known contents of
+	// files, so that saving a file without changing it doesn't count.
+	files map[string]fileContents
+}
 
-	events chan notify.EventInfo
+type fileContents struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+	// Empty if the file couldn't be read, or isn't a regular file.
+	hash string
 }
 
-func NewWatcher(dir string) *Watcher {
-	w := Watcher{}
-	w.Changes = make(chan string)
-	w.events = make(chan notify.EventInfo, 100)
+// Files bigger than this are assumed to have changed, rather than read.
+const maxHashSize = 64 << 20
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
 
+// checkContents hashes a file and reports whether its contents differ from
+// the last time it was seen. Files it hasn't seen before, or couldn't read,
+// count as changed.
+func (w *Watcher) checkContents(p string, info os.FileInfo) (string, bool) {
+	old, known := w.files[p]
+	if known && old.size == info.Size() && old.modTime.Equal(info.ModTime()) {
+		return old.hash, false
+	}
+	cur := fileContents{isDir: info.IsDir(), size: info.Size(), modTime: info.ModTime()}
+	if info.Mode().IsRegular() && info.Size() <= maxHashSize {
+		cur.hash, _ = hashFile(p)
+	}
+	w.files[p] = cur
+	return cur.hash, cur.hash == "" || cur.hash != old.hash
+}
+
+type hashedFile struct {
+	path string
+	fileContents
+}
+
+// seed records what's already in the tree, and then hashes the files in the
+// background, so that even the first save which doesn't change one isn't
+// reported. Until a file's hash comes in, any change to its size or
+// modification time counts.
+func (w *Watcher) seed() {
+	files, err := scan(w.dir, w.opts.Exclude, w.opts.Ignore)
+	if err != nil {
+		close(w.hashed)
+		close(w.seeded)
+		return
+	}
+	var toHash []string
+	for p, state := range files {
+		w.files[p] = fileContents{isDir: state.isDir, size: state.size, modTime: state.modTime}
+		if state.isDir || state.size > maxHashSize {
+			continue
+		}
+		relpath, err := filepath.Rel(w.dir, p)
+		if err != nil {
+			continue
+		}
+		relpath = filepath.ToSlash(relpath)
+		if (w.opts.Include != nil && !w.opts.Include(relpath)) ||
+			(w.opts.Ignore != nil && w.opts.Ignore(relpath, false)) {
+			continue
+		}
+		toHash = append(toHash, p)
+	}
 	go func() {
-		// A text editor may save a file in several steps, like creating a
-		// temporary file and then renaming it on top of the original, or
-		// creating a backup file and then deleting it.
-		//
-		// To squash the noise, the top-level loop waits for one event, then
-		// sets a timeout and collects any additional events that arrive before
-		// it fires, then dispatches events only for files which still exist at
-		// the end. (As a result, deletes aren't reported; that's fine for the
-		// use case of "reload files that change".)
-		for {
-			event := <-w.events
-			touched := make(map[string]bool)
-			handle := func(event notify.EventInfo) {
-				touched[event.Path()] = true
+		defer close(w.seeded)
+		defer close(w.hashed)
+		for _, p := range toHash {
+			state := files[p]
+			hash, err := hashFile(p)
+			if err != nil {
+				continue
 			}
-			handle(event)
-
-			// 3ms felt right, but might not be.
-			for timeout := time.After(3 * time.Millisecond); timeout != nil; {
-				select {
-				case event := <-w.events:
-					handle(event)
-				case <-timeout:
-					timeout = nil
-				}
+			// If the file changed while it was being read, the hash can't be
+			// trusted.
+			info, err := os.Stat(p)
+			if err != nil || info.Size() != state.size || !info.ModTime().Equal(state.modTime) {
+				continue
+			}
+			select {
+			case w.hashed <- hashedFile{p, fileContents{size: state.size, modTime: state.modTime, hash: hash}}:
+			case <-w.done:
+				return
 			}
+		}
+	}()
+}
 
-			absDir, _ := filepath.EvalSymlinks(dir)
+// addHash fills in the hash of a file from seed, unless the file has been
+// seen to change since.
+func (w *Watcher) addHash(f hashedFile) {
+	cur, ok := w.files[f.path]
+	if ok && cur.hash == "" && !cur.isDir && cur.size == f.size && cur.modTime.Equal(f.modTime) {
+		w.files[f.path] = f.fileContents
+	}
+}
 
-			for path, _ := range touched {
-				if (!strings.HasSuffix(path, "/.reserveignore") &&
-					hasHiddenComponent(path)) ||
-					// Vim backup files. This check can be tightened up if it's an
-					// issue for anyone.
-					strings.HasSuffix(path, "~") {
-					continue
-				}
-				if _, err := os.Stat(path); err != nil {
+// forget drops a path that's gone, and everything in it if it was a
+// directory, in case some of that went unreported.
+func (w *Watcher) forget(p string, isDir bool) {
+	delete(w.files, p)
+	if !isDir {
+		return
+	}
+	prefix := p + string(filepath.Separator)
+	for other := range w.files {
+		if strings.HasPrefix(other, prefix) {
+			delete(w.files, other)
+		}
+	}
+}
+
+// touch collects the events seen for one path during a coalescing window.
+type touch struct {
+	renamed bool
+}
+
+// NewWatcher starts watching dir and everything in it. Changes are delivered
+// on the returned Watcher's Changes channel until it's closed.
+func NewWatcher(dir string, opts Options) (*Watcher, error) {
+	absDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Quiet <= 0 {
+		opts.Quiet = DefaultQuiet
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = DefaultMaxWait
+	}
+	if opts.Exclude == nil {
+		opts.Exclude = DefaultExclude
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	w := &Watcher{
+		Changes: make(chan Change),
+		dir:     absDir,
+		opts:    opts,
+		events:  make(chan notify.EventInfo, 100),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		hashed:  make(chan hashedFile),
+		seeded:  make(chan struct{}),
+		files:   make(map[string]fileContents),
+	}
+	w.seed()
+	if !opts.Poll {
+		w.source, err = startNotify(dir, w.events)
+	}
+	if opts.Poll || err != nil {
+		w.polling = true
+		w.source, err = startPolling(absDir, opts.PollInterval, opts.Exclude, opts.Ignore, w.events)
+		if err != nil {
+			return nil, err
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching and closes Changes. It's safe to call more than once.
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		w.source.stop()
+		close(w.done)
+		<-w.stopped
+	})
+	return nil
+}
+
+// Polling reports whether the watcher is scanning for changes instead of
+// getting notifications from the OS.
+func (w *Watcher) Polling() bool {
+	return w.polling
+}
+
+func (w *Watcher) run() {
+	defer close(w.stopped)
+	defer close(w.Changes)
+
+	// A text editor may save a file in several steps, like creating a
+	// temporary file and then renaming it on top of the original, or
+	// creating a backup file and then deleting it.
+	//
+	// To squash the noise, the top-level loop waits for one event, then
+	// collects any additional events until things have been quiet for a
+	// moment (or a stream of events has gone on for too long), then looks at
+	// which files still exist at the end to decide what happened to each
+	// one. Files which were created and then went away again within the
+	// window aren't reported at all.
+	hashed := w.hashed
+	for {
+		var event notify.EventInfo
+		select {
+		case event = <-w.events:
+		case f, ok := <-hashed:
+			if !ok {
+				hashed = nil
+			} else {
+				w.addHash(f)
+			}
+			continue
+		case <-w.done:
+			return
+		}
+		touched := make(map[string]*touch)
+		var order []string
+		handle := func(event notify.EventInfo) {
+			t, ok := touched[event.Path()]
+			if !ok {
+				t = &touch{}
+				touched[event.Path()] = t
+				order = append(order, event.Path())
+			}
+			if event.Event()&notify.Rename != 0 {
+				t.renamed = true
+			}
+		}
+		handle(event)
+
+		deadline := time.After(w.opts.MaxWait)
+		for quiet := time.After(w.opts.Quiet); quiet != nil; {
+			select {
+			case event := <-w.events:
+				handle(event)
+				quiet = time.After(w.opts.Quiet)
+			case <-quiet:
+				quiet = nil
+			case <-deadline:
+				quiet = nil
+			case <-w.done:
+				return
+			}
+		}
+
+		var changes []Change
+		var movedFrom, movedTo []int
+		for _, path := range order {
+			relpath, err := filepath.Rel(w.dir, path)
+			if err != nil {
+				continue
+			}
+			relpath = filepath.ToSlash(relpath)
+			if (w.opts.Include != nil && !w.opts.Include(relpath)) ||
+				w.opts.Exclude(relpath) {
+				continue
+			}
+			t := touched[path]
+			info, err := os.Stat(path)
+			exists := err == nil
+			// Events aren't always delivered in order, and saving a file
+			// can involve creating it again, so what happened depends on
+			// whether the path was there before.
+			old, existed := w.files[path]
+			var kind Kind
+			switch {
+			case exists && existed:
+				kind = Modified
+			case exists:
+				kind = Created
+			case existed:
+				kind = Removed
+			default:
+				continue
+			}
+			var hash string
+			isDir := old.isDir
+			if exists {
+				isDir = info.IsDir()
+				var changed bool
+				if hash, changed = w.checkContents(path, info); !changed {
 					continue
 				}
-				relpath, err := filepath.Rel(absDir, path)
-				if err != nil {
-					log.Fatal(err)
-				}
-				w.Changes <- relpath
+			} else {
+				w.forget(path, old.isDir)
+			}
+			if kind == Removed && t.renamed {
+				movedFrom = append(movedFrom, len(changes))
+			} else if kind == Created || (kind == Modified && t.renamed) {
+				movedTo = append(movedTo, len(changes))
 			}
+			changes = append(changes, Change{Kind: kind, Path: relpath, Hash: hash, IsDir: isDir})
 		}
-	}()
 
-	err := notify.Watch(filepath.Join(dir, "..."), w.events, notify.All)
-	if err != nil {
-		log.Fatal(err)
+		// Events don't say where a renamed file went, but if exactly one
+		// file disappeared by being renamed and exactly one appeared, it's
+		// a safe bet that they're the same file.
+		if len(movedFrom) == 1 && len(movedTo) == 1 {
+			from, to := movedFrom[0], movedTo[0]
+			changes[to].Kind = Renamed
+			changes[to].From = changes[from].Path
+			changes = append(changes[:from], changes[from+1:]...)
+		}
+
+		for _, change := range changes {
+			select {
+			case w.Changes <- change:
+			case <-w.done:
+				return
+			}
+		}
 	}
-	return &w
 }
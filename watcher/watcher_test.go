@@ -0,0 +1,224 @@
+// Copyright 2019 The Reserve Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// forEachSource runs a test once with OS notifications and once polling.
+func forEachSource(t *testing.T, f func(t *testing.T, opts Options)) {
+	t.Run("notify", func(t *testing.T) {
+		f(t, Options{Quiet: 20 * time.Millisecond})
+	})
+	t.Run("poll", func(t *testing.T) {
+		f(t, Options{Quiet: 20 * time.Millisecond, Poll: true, PollInterval: 10 * time.Millisecond})
+	})
+}
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startWatcher watches a new temporary directory after creating the given
+// files in it.
+func startWatcher(t *testing.T, opts Options, files map[string]string) (*Watcher, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, dir, name, contents)
+	}
+	w, err := NewWatcher(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Polling() != opts.Poll {
+		t.Fatalf("Polling() = %v, want %v", w.Polling(), opts.Poll)
+	}
+	t.Cleanup(func() { w.Close() })
+	// Tests expect the watcher to know what's in the files it started with.
+	select {
+	case <-w.seeded:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the watcher to read existing files")
+	}
+	return w, dir
+}
+
+func expectChange(t *testing.T, w *Watcher, want Change) {
+	t.Helper()
+	select {
+	case got, ok := <-w.Changes:
+		if !ok {
+			t.Fatalf("Changes closed, want %+v", want)
+		}
+		got.Hash = ""
+		if got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %+v", want)
+	}
+}
+
+func expectNoChange(t *testing.T, w *Watcher) {
+	t.Helper()
+	select {
+	case got := <-w.Changes:
+		t.Fatalf("got unexpected %+v", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestCreate(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, nil)
+		writeFile(t, dir, "a.txt", "a")
+		expectChange(t, w, Change{Kind: Created, Path: "a.txt"})
+	})
+}
+
+func TestModify(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, map[string]string{"a.txt": "a"})
+		writeFile(t, dir, "a.txt", "changed")
+		expectChange(t, w, Change{Kind: Modified, Path: "a.txt"})
+	})
+}
+
+func TestRemove(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, map[string]string{"a.txt": "a"})
+		if err := os.Remove(filepath.Join(dir, "a.txt")); err != nil {
+			t.Fatal(err)
+		}
+		expectChange(t, w, Change{Kind: Removed, Path: "a.txt"})
+	})
+}
+
+func TestRename(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, map[string]string{"a.txt": "a"})
+		if err := os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")); err != nil {
+			t.Fatal(err)
+		}
+		expectChange(t, w, Change{Kind: Renamed, Path: "b.txt", From: "a.txt"})
+		expectNoChange(t, w)
+	})
+}
+
+func TestClose(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, nil)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, dir, "a.txt", "a")
+		select {
+		case got, ok := <-w.Changes:
+			if ok {
+				t.Fatalf("got %+v after Close", got)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("Changes wasn't closed")
+		}
+	})
+}
+
+func TestSameContents(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, map[string]string{"a.txt": "a"})
+		// Make sure the modification time moves, even on coarse filesystems.
+		later := time.Now().Add(time.Minute)
+		writeFile(t, dir, "a.txt", "a")
+		if err := os.Chtimes(filepath.Join(dir, "a.txt"), later, later); err != nil {
+			t.Fatal(err)
+		}
+		expectNoChange(t, w)
+		writeFile(t, dir, "a.txt", "b")
+		expectChange(t, w, Change{Kind: Modified, Path: "a.txt"})
+	})
+}
+
+// Editors often save by moving the old file out of the way, or by writing a
+// temporary file and moving it into place. Either way, the file was
+// modified.
+func TestAtomicSave(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, map[string]string{"a.txt": "a"})
+		a := filepath.Join(dir, "a.txt")
+		if err := os.Rename(a, a+"~"); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, dir, "a.txt", "backed up")
+		expectChange(t, w, Change{Kind: Modified, Path: "a.txt"})
+		expectNoChange(t, w)
+
+		writeFile(t, dir, ".a.txt.tmp", "from a temporary file")
+		if err := os.Rename(filepath.Join(dir, ".a.txt.tmp"), a); err != nil {
+			t.Fatal(err)
+		}
+		expectChange(t, w, Change{Kind: Modified, Path: "a.txt"})
+		expectNoChange(t, w)
+	})
+}
+
+// A directory that's removed is still reported as one, for callers which
+// treat directories differently.
+func TestRemoveDir(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		w, dir := startWatcher(t, opts, nil)
+		sub := filepath.Join(dir, "sub")
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		expectChange(t, w, Change{Kind: Created, Path: "sub", IsDir: true})
+		if err := os.Remove(sub); err != nil {
+			t.Fatal(err)
+		}
+		expectChange(t, w, Change{Kind: Removed, Path: "sub", IsDir: true})
+	})
+}
+
+// Ignored directories aren't looked inside when the watcher starts.
+func TestIgnore(t *testing.T) {
+	forEachSource(t, func(t *testing.T, opts Options) {
+		opts.Ignore = func(p string, isDir bool) bool {
+			return p == "big" && isDir
+		}
+		w, _ := startWatcher(t, opts, map[string]string{"big/a.txt": "a"})
+		w.Close()
+		if _, ok := w.files[filepath.Join(w.dir, "big")]; !ok {
+			t.Error("big wasn't recorded")
+		}
+		if _, ok := w.files[filepath.Join(w.dir, "big", "a.txt")]; ok {
+			t.Error("big/a.txt was recorded")
+		}
+	})
+}